@@ -7,15 +7,14 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/go-chi/httplog"
-	"golang.org/x/exp/slog"
+	"github.com/piscopoc/httplog/v2"
 )
 
 func main() {
 	// Logger
 	logger := httplog.NewLogger("httplog-example", httplog.Options{
 		JSON:            false,
-		LogLevel:        slog.LevelDebug,
+		LogLevel:        "debug",
 		Concise:         true,
 		TimeFieldFormat: time.RFC850,
 		Tags: map[string]string{
@@ -59,7 +58,7 @@ func main() {
 
 	r.Get("/err", func(w http.ResponseWriter, r *http.Request) {
 		oplog := httplog.LogEntry(r.Context())
-		oplog.Error("msg here", errors.New("err here"))
+		oplog.Error("msg here", "err", errors.New("err here"))
 		w.WriteHeader(500)
 		w.Write([]byte("err here"))
 	})
@@ -0,0 +1,112 @@
+package httplog
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// clientIP resolves the IP of the client behind the trusted proxies, walking
+// the X-Forwarded-For, Forwarded and X-Real-IP headers from the nearest hop.
+// Addresses added by untrusted hops can't be relied on, so the first
+// untrusted address found is the client. Without trusted proxies in front,
+// it's the direct peer.
+func clientIP(r *http.Request, trusted []netip.Prefix) string {
+	isTrusted := func(addr netip.Addr) bool {
+		for _, prefix := range trusted {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	peer, ok := parseIP(r.RemoteAddr)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if !isTrusted(peer) {
+		return peer.String()
+	}
+
+	var hops []string
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		for _, value := range xff {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+	} else if fwd := r.Header.Values("Forwarded"); len(fwd) > 0 {
+		hops = forwardedFor(fwd)
+	} else if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		hops = []string{realIP}
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseIP(hops[i])
+		if !ok {
+			// eg. an obfuscated Forwarded identifier, nothing beyond can be trusted
+			break
+		}
+		client = addr
+		if !isTrusted(addr) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// forwardedFor returns the for= addresses of the Forwarded header (RFC 7239)
+// in order.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hops = append(hops, strings.Trim(v, `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parseIP parses an IP address which may have a port or be in brackets, eg.
+// "192.0.2.1", "192.0.2.1:8080" or "[2001:db8::1]:8080".
+func parseIP(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	addr, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// parseProxies parses trusted proxies given as CIDRs or single IPs, skipping
+// invalid ones which Options.Validate reports.
+func parseProxies(proxies []string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		if prefix, err := parseProxy(proxy); err == nil {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+func parseProxy(proxy string) (netip.Prefix, error) {
+	if strings.Contains(proxy, "/") {
+		prefix, err := netip.ParsePrefix(proxy)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(proxy)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
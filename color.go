@@ -6,6 +6,7 @@ package httplog
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"os"
 )
 
@@ -51,6 +52,21 @@ func init() {
 	}
 }
 
+// isTerminal reports whether w is a file which looks like a terminal, using
+// the same heuristic as IsTTY. Pretty output to anything else is uncolored.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	m := os.ModeDevice | os.ModeCharDevice
+	return fi.Mode()&m == m
+}
+
 // colorWrite
 func cW(w *bytes.Buffer, useColor bool, color []byte, s string, args ...interface{}) {
 	if IsTTY && useColor {
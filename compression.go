@@ -0,0 +1,34 @@
+package httplog
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// CountUncompressed is an http middleware counting the bytes of the response
+// body written by the handlers below it, for the "uncompressed_bytes" and
+// "compression_ratio" fields of responses with a Content-Encoding. It goes
+// between a compression middleware, such as chi's middleware.Compress, and
+// the handlers, with Handler before the compression, eg.
+//
+//	r.Use(httplog.Handler(logger))
+//	r.Use(middleware.Compress(5))
+//	r.Use(httplog.CountUncompressed)
+func CountUncompressed(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		entry, _ := middleware.GetLogEntry(r).(*RequestLoggerEntry)
+		if entry == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w, ww := newResponseWriter(w, r.ProtoMajor)
+		defer func() {
+			entry.mu.Lock()
+			defer entry.mu.Unlock()
+			entry.uncompressed = ww.BytesWritten()
+		}()
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
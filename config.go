@@ -1,36 +1,58 @@
 package httplog
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/netip"
 	"os"
+	"path"
 	"strings"
 	"time"
-
-	"golang.org/x/exp/slog"
 )
 
+// DefaultOptions are the options NewLogger, OptionsFromEnv and LoadConfig
+// start out with. Changes to it only affect loggers created afterwards, so
+// it should be set up before serving requests.
 var DefaultOptions = Options{
-	LogLevel:        "info",
-	LevelFieldName:  "level",
-	JSON:            false,
-	Concise:         false,
-	Tags:            nil,
-	SkipHeaders:     nil,
-	QuietDownRoutes: nil,
-	QuietDownPeriod: 0,
-	TimeFieldFormat: time.RFC3339Nano,
-	TimeFieldName:   "timestamp",
+	LogLevel:         "info",
+	LevelFieldName:   "level",
+	MessageFieldName: "msg",
+	JSON:             false,
+	Concise:          false,
+	Tags:             nil,
+	SkipHeaders:      nil,
+	QuietDownRoutes:  nil,
+	QuietDownPeriod:  0,
+	TimeFieldFormat:  time.RFC3339Nano,
+	TimeFieldName:    "timestamp",
 }
 
 type Options struct {
 	// LogLevel defines the minimum level of severity that app should log.
 	// Must be one of:
-	// "debug", "info", "warn", "error"
+	// "trace", "debug", "info", "warn", "error"
+	// or a name defined in Levels.
 	LogLevel string
 
+	// Levels defines additional named levels, eg.
+	// {"notice": slog.LevelInfo + 2, "critical": slog.LevelError + 4}.
+	// The names may be used for LogLevel and RouteLevels, and levels are
+	// logged with their upper-cased name instead of eg. "ERROR+4". A custom
+	// name may also replace the name of a built-in level.
+	Levels map[string]slog.Level
+
 	// LevelFieldName sets the field name for the log level or severity.
 	// Some providers parse and search for different field names.
 	LevelFieldName string
 
+	// MessageFieldName sets the field name for the log message, eg. "message"
+	// as expected by some providers. Defaults to "msg".
+	MessageFieldName string
+
 	// JSON enables structured logging output in json. Make sure to enable this
 	// in production mode so log aggregators can receive data in parsable format.
 	//
@@ -38,62 +60,994 @@ type Options struct {
 	// receive pretty output and stacktraces to stdout.
 	JSON bool
 
+	// RouteLevels overrides LogLevel for requests whose path matches a pattern,
+	// eg. {"/healthz": "warn", "/payments/*": "debug"}. Patterns are exact
+	// paths, path.Match patterns like "/v1/*/events", end in "/*" to match
+	// everything under a prefix, or are regular expressions prefixed with
+	// "~", eg. "~^/v[0-9]+/admin/". If several patterns match, an exact path wins
+	// over wildcards and otherwise the longest pattern wins. The override
+	// applies to all logs of the request, including those written through
+	// LogEntry.
+	RouteLevels map[string]string
+
+	// LevelByStatus overrides the level of the response log, which by default
+	// is error for 5xx, warn for 4xx and unknown statuses and info otherwise.
+	// Keys are either exact statuses, eg. {404: slog.LevelInfo}, or status
+	// classes 1 to 5, eg. {4: slog.LevelInfo} for all 4xx. Exact statuses take
+	// precedence over classes.
+	LevelByStatus map[int]slog.Level
+
+	// SlowRequestThreshold raises the response log to at least warn for
+	// requests taking longer, and adds a "slow" field to all response logs.
+	SlowRequestThreshold time.Duration
+
+	// SlowRequestErrorThreshold raises the response log to at least error for
+	// requests taking longer, marking them slow as well.
+	SlowRequestErrorThreshold time.Duration
+
 	// Concise mode includes fewer log details during the request flow. For example
 	// excluding details like request content length, user-agent and other details.
 	// This is useful if during development your console is too noisy.
 	Concise bool
 
+	// SingleLine leaves out the "Request: ..." line logged when a request
+	// starts, so each request is logged as exactly one "canonical" line with
+	// both the request and response fields. Unlike Concise it keeps all
+	// details.
+	SingleLine bool
+
+	// TailBuffering holds back all logs of a request, at any level, until it
+	// finishes. They're only written if its response is logged at error
+	// level, it took longer than TailLatency, it has the TailDebugHeader or
+	// a handler called KeepLogs, and dropped otherwise. This gives full
+	// detail for failed requests without the noise of successful ones. The
+	// response line itself is always logged. Unlike the other options holding
+	// back logs, eg. SkipMethods, it writes logs below LogLevel as well.
+	TailBuffering bool
+
+	// TailLatency writes the buffered logs of requests taking longer, with
+	// TailBuffering. Zero disables it.
+	TailLatency time.Duration
+
+	// TailDebugHeader is a request header, eg. "X-Debug-Logs", which makes
+	// the buffered logs be written when present, with TailBuffering.
+	TailDebugHeader string
+
+	// StartLevel is the level of the "Request: ..." line logged when a
+	// request starts, "info" by default. Set to eg. "debug" to only see the
+	// start lines in development, while the response lines keep their level
+	// by status.
+	StartLevel string
+
+	// FlatFields emits the request and response fields at the root of the log
+	// record instead of nested in the "httpRequest" and "httpResponse" groups.
+	// The response header is then logged as "responseHeader".
+	FlatFields bool
+
+	// SemConv renames the fields to the OpenTelemetry semantic conventions,
+	// eg. "http.request.method", "http.response.status_code", "url.path" or
+	// "network.peer.address", so OTel-native backends can ingest the logs
+	// without remapping. It implies FlatFields. FieldNames still take
+	// precedence.
+	SemConv bool
+
+	// ServiceName is logged as the "service" field of all logs, overriding the
+	// name passed to NewLogger.
+	ServiceName string
+
+	// ServiceVersion, if set, is logged as the "version" field of all logs.
+	ServiceVersion string
+
+	// IncludeHostInfo includes the "host" name and "pid" of the process in all
+	// logs, so lines from multiple instances of a service can be told apart.
+	IncludeHostInfo bool
+
+	// SchemaVersion includes a "log_schema_version" field with the value of
+	// LogSchemaVersion in all logs, so parsers can tell apart the field
+	// layouts of different httplog versions.
+	SchemaVersion bool
+
+	// LogRequestBody includes the request body read by the handler as the
+	// "requestBody" field of the response log, up to BodyMaxBytes. The body is
+	// captured while the handler reads it, so streaming isn't affected.
+	LogRequestBody bool
+
+	// LogResponseBody includes the response body, up to BodyMaxBytes, as the
+	// "body" field of all response logs. Without it, the body is only logged
+	// for error responses and not in Concise mode.
+	LogResponseBody bool
+
+	// LogBandwidth adds the "bytes_in" and "bytes_out" fields to response
+	// logs, the bytes of the request body the handler read and of the response
+	// body written to the client, counting short and failed writes as far as
+	// they got, for bandwidth accounting.
+	LogBandwidth bool
+
+	// ResponseBodyMinStatus captures response bodies even in Concise mode, but
+	// only logs them for responses with a status of at least this, eg. 500,
+	// so that successful responses don't bloat the logs. Zero keeps the
+	// default of logging bodies for status >= 400 when not Concise.
+	// LogResponseBody takes precedence.
+	ResponseBodyMinStatus int
+
+	// BodyMaxBytes is the maximum number of bytes of a request or response
+	// body to log, defaulting to 512. Longer bodies are truncated and marked
+	// with a "requestBodyTruncated" or "bodyTruncated" field.
+	BodyMaxBytes int
+
+	// BodyContentTypes are the media types of bodies which are logged, as
+	// path.Match patterns such as "text/*" or "application/*+json". Other
+	// bodies, eg. images, protobuf or octet-streams, are replaced by their
+	// content type and size in the "bodyContentType" and "bodySize" fields
+	// (or "requestBodyContentType" and "requestBodySize"). Bodies without a
+	// Content-Type header are sniffed with http.DetectContentType. Defaults to
+	// DefaultBodyContentTypes if nil.
+	BodyContentTypes []string
+
+	// RedactJSONPaths are fields of logged JSON bodies whose values are
+	// replaced by "[redacted]", eg. "password", "card.number" or "*.token".
+	// Paths are dot separated object keys where "*" matches any key, and
+	// arrays are descended into. JSON bodies which can't be parsed, eg.
+	// because they were truncated, are redacted as a whole.
+	RedactJSONPaths []string
+
+	// RedactQueryParams are query parameters whose values are replaced by
+	// "***" in the logged request URL, eg. "access_token". The request itself
+	// is left untouched. Names are matched case-insensitively.
+	RedactQueryParams []string
+
+	// Masks enables BuiltinMasks by name, eg. "creditcard", "email" or
+	// "bearer", masking matching PII in logged header values, request URLs
+	// and bodies.
+	Masks []string
+
+	// MaskRules are additional regular expressions masked like Masks.
+	MaskRules []MaskRule
+
 	// Tags are additional fields included at the root level of all logs.
 	// These can be useful for example the commit hash of a build, or an environment
 	// name like prod/stg/dev
 	Tags map[string]string
 
-	// SkipHeaders are additional headers which are redacted from the logs
+	// Attrs are additional fields included at the root level of all logs. Unlike
+	// Tags they keep their type, eg. slog.Int("shard", 3), and are included in
+	// Concise mode as well.
+	Attrs []slog.Attr
+
+	// DynamicTags, if set, is called once per request to compute additional
+	// fields for all of its logs, eg. a tenant or region derived from the
+	// request headers or context.
+	DynamicTags func(r *http.Request) []slog.Attr
+
+	// ErrorChains unwraps errors recorded with SetError, logging the message
+	// of each cause as errorCauses and the type of the innermost one as
+	// errorRootType, so wrapped errors are searchable without parsing
+	// strings. Errors logged as attribute values, eg. slog.Any("err", err),
+	// become a group of their message, errorCauses and errorRootType.
+	ErrorChains bool
+
+	// StackTraceOnError attaches the goroutine's stack trace as a "stacktrace"
+	// field to logs at error level or above written through LogEntry. In
+	// pretty mode the stack trace is printed as a block below the log line.
+	StackTraceOnError bool
+
+	// NormalizePaths logs the path of requests with numeric, UUID and hex hash
+	// segments collapsed into ":id", ":uuid" and ":hash" as the route field,
+	// eg. "/orders/:id" for "/orders/123", if the router doesn't provide a
+	// route pattern. This keeps the cardinality of log-based metrics bounded.
+	NormalizePaths bool
+
+	// PathRules are additional rewrites of the path logged as the route
+	// field, applied before NormalizePaths.
+	PathRules []PathRule
+
+	// TrustedProxies are the CIDRs or IPs of the load balancers and proxies in
+	// front of the service, eg. "10.0.0.0/8". If set, the IP of the client
+	// behind them is resolved from the X-Forwarded-For, Forwarded or
+	// X-Real-IP headers and logged as clientIP, next to the direct peer in
+	// remoteIP. Only hops added by trusted proxies are believed.
+	TrustedProxies []string
+	// trustedProxies are the parsed TrustedProxies, set by Configure
+	trustedProxies []netip.Prefix
+
+	// RequestIDHeader is the header of incoming requests whose value the
+	// RequestID middleware reuses as the request ID, so logs across services
+	// share the same correlation ID. Defaults to "X-Request-Id", "-" turns
+	// reusing incoming IDs off. IDs longer than 128 characters or with
+	// non-printable characters are ignored.
+	RequestIDHeader string
+
+	// CorrelationIDHeader is the header carrying the ID of a chain of calls
+	// across services, eg. "X-Correlation-Id", logged as the correlation_id
+	// field on every line of a request. Requests without it start a new chain
+	// with their request ID.
+	CorrelationIDHeader string
+
+	// ParentIDHeader is the header carrying the request ID of the calling
+	// service, eg. "X-Parent-Id", logged as the parent_id field on every
+	// line of a request.
+	ParentIDHeader string
+
+	// TracePropagators are the formats in which the trace context of requests
+	// is read from their headers, tried in order: "tracecontext" for the W3C
+	// traceparent header, "b3" for the single B3 header and "b3multi" for the
+	// X-B3-* headers. The trace is logged as trace_id, span_id and trace_flags
+	// fields on every line of a request, so logs can be joined with
+	// distributed traces. B3 sampling states are logged as trace flags "01"
+	// (sampled) or "00". The trace of an active OpenTelemetry span in the
+	// request context is always logged, and takes precedence.
+	TracePropagators []string
+
+	// OTelSpan adds the response status, size and latency to the active
+	// OpenTelemetry span of the request, as "attributes" or as an "event".
+	// Spans of responses with a status >= 500 are marked as errors.
+	OTelSpan string
+
+	// IDGenerator generates the IDs of requests in the RequestID middleware,
+	// eg. UUIDv4, UUIDv7 or ULID. Defaults to a random 128-bit hex string.
+	IDGenerator func(r *http.Request) string
+
+	// EchoRequestID makes the RequestID middleware set the request ID on the
+	// response in the RequestIDHeader (or "X-Request-Id" if that's "-"), so
+	// clients can quote it in support tickets.
+	EchoRequestID bool
+
+	// AuthFingerprint logs the Authorization header as its scheme and a short
+	// fingerprint of the credentials, eg. "Bearer sha256:ab12cd34…", instead
+	// of "***", so the credential used can be correlated without exposing it.
+	AuthFingerprint bool
+
+	// CookieLogging sets how the Cookie and Set-Cookie headers are logged:
+	// "redact" (default) replaces them by "***", "omit" leaves them out and
+	// "names" logs the cookie names with their values replaced by "***",
+	// except for SafeCookies.
+	CookieLogging string
+
+	// SafeCookies are the names of cookies whose values are logged with
+	// CookieLogging "names", eg. a locale or feature flag cookie.
+	SafeCookies []string
+
+	// SkipHeaders are additional headers which are redacted from the logs.
+	// Entries may be path.Match patterns such as "x-internal-*" or
+	// "*-token", or case-insensitive regular expressions prefixed with "~",
+	// eg. "~^x-(api|auth)-key$".
 	SkipHeaders []string
 
+	// OnlyHeaders switches header logging to an allowlist: if set, only the
+	// named request and response headers are logged and all others are left
+	// out. Entries may be patterns like for SkipHeaders. Authorization and
+	// cookies are still redacted as usual.
+	OnlyHeaders []string
+
+	// LogResponseHeaders selects the response headers to log, eg.
+	// "content-type", "cache-control" or "x-ratelimit-*", in Concise mode as
+	// well. Entries may be patterns like for SkipHeaders. If nil, all response
+	// headers allowed by OnlyHeaders are logged when not Concise.
+	LogResponseHeaders []string
+
+	// SkipPaths excludes requests whose path matches any of the patterns
+	// from logging completely, eg. "/favicon.ico", "/static/*" or
+	// "~^/assets/.+\.js$". Patterns are written like for RouteLevels. Unlike
+	// QuietDownRoutes, they're excluded for good, failures included.
+	SkipPaths []string
+
+	// OnlyPaths switches path filtering to an allowlist: if set, only
+	// requests whose path matches any of the patterns are logged, eg.
+	// "/api/*", leaving out metrics scrapes, probes and the like. Patterns are
+	// written like for RouteLevels, and SkipPaths still applies.
+	OnlyPaths []string
+
+	// SkipMethods excludes requests with any of the methods from logging, eg.
+	// "OPTIONS" for CORS preflights or "HEAD", unless they fail, ie. their
+	// response is logged at warn level or above. The logs of such requests
+	// are held back until then, those below LogLevel are dropped as usual.
+	SkipMethods []string
+
+	// StaticExtensions are file extensions of static assets, eg. ".css" or
+	// ".woff2", whose successful requests are logged at debug level, keeping
+	// the access logs at info level focused on API traffic. Failed requests
+	// keep their level. See DefaultStaticExtensions for a common set.
+	StaticExtensions []string
+
+	// LogHealthChecks turns off the detection of health checks, which are
+	// otherwise logged at debug level when successful like static assets.
+	// Health checks are requests to common probe paths such as "/healthz",
+	// "/readyz" or "/ping", or from probes such as kube-probe or
+	// ELB-HealthChecker, identified by their User-Agent.
+	LogHealthChecks bool
+
+	// Skip is called after the handler ran and leaves out the response log of
+	// the request if it returns true, for filtering beyond what the options
+	// above offer. It has the final say, server errors are left out as well.
+	// Logs held back by TailBuffering or the noise controls are dropped.
+	Skip func(r *http.Request, status int, elapsed time.Duration) bool
+
+	// SampleRate logs only this fraction, between 0 and 1, of successful
+	// requests, ie. those logged below warn level. Zero logs all of them.
+	// The decision is made once per request, from its request ID if there is
+	// one, so services sharing the ID sample the same requests. Response logs
+	// get a "sampled" field, false for failed requests which were logged
+	// although not sampled. Requests not sampled have no start line.
+	SampleRate float64
+
+	// RouteRateLimit caps the response logs of each route, as matched by the
+	// router or normalized, or else of each path, to this many per second with
+	// bursts of as many. Further lines are dropped, and once logs of the route
+	// are let through again a warning with the number of "suppressed" lines is
+	// logged before them. It's a gentler alternative to QuietDownRoutes.
+	// Response logs at warn level or above are never limited. Zero disables it.
+	RouteRateLimit float64
+
+	// FloodLimit caps all logs of the logger, not only those of the
+	// middleware, at this many records per second. Beyond it records are
+	// sampled, keeping fewer the more there are, and a warning with the number
+	// suppressed is logged in the following second. This protects the service
+	// and the log pipeline during request storms. Zero disables it.
+	FloodLimit int
+
+	// SuppressErrors lets the noise controls, ie. QuietDownRoutes, SampleRate,
+	// RouteRateLimit and FloodLimit, hide the logs of requests answered with
+	// a 5xx status or a panic as well. By default these are always logged,
+	// with all logs of the request held back by QuietDownRoutes, so the noise
+	// controls can never hide incidents.
+	SuppressErrors bool
+
 	// QuietDownRoutes are routes which are temporarily excluded from logging for a QuietDownPeriod after it occurs
 	// for the first time
 	// to cancel noise from logging for routes that are known to be noisy.
+	//
+	// Routes may be patterns like for RouteLevels, eg. "/debug/*" or
+	// "/v1/*/events", quieting all matching paths together. An entry may be
+	// followed by the status it applies to, eg. "/metrics:200" or
+	// "/metrics:2xx", to quiet only responses with that status while others
+	// are always logged. Each entry is quieted on its own.
+	//
+	// Routes may be added and removed at runtime with Logger.QuietRoute and
+	// Logger.UnquietRoute.
+	//
+	// When a quiet period ends, a summary of the requests suppressed during
+	// it is logged, with their number, "statuses" and "p50" and "p99"
+	// latency.
 	QuietDownRoutes []string
 
 	// QuietDownPeriod is the duration for which a route is excluded from logging after it occurs for the first time
 	// if the route is in QuietDownRoutes
 	QuietDownPeriod time.Duration
 
+	// QuietDownOnlySuccess never quiets failed or slow requests, ie. those
+	// with a 4xx or 5xx status or logged at warn level or above, eg. because
+	// of SlowRequestThreshold. A noisy but healthy route stays quiet, while
+	// anomalies on it surface immediately. They don't count toward the quiet
+	// period either.
+	QuietDownOnlySuccess bool
+
+	// QuietDownPersister saves the quiet periods of QuietDownRoutes and
+	// QuietDownStore.Silence and restores them when the logger is first
+	// configured, so frequently restarted services don't log their noisy
+	// routes again for another full period, eg. QuietDownFile("quiet.json").
+	// Errors saving or restoring them are logged as warnings.
+	QuietDownPersister QuietDownPersister
+
+	// QuietDownSampleEvery still logs every nth request to a route during its
+	// QuietDownPeriod, with the number of requests "suppressed" since the last
+	// one logged, so there's a sign the route is alive and how it performs.
+	// Zero logs none.
+	QuietDownSampleEvery int
+
 	// TimeFieldFormat defines the time format of the Time field, defaulting to "time.RFC3339Nano" see options at:
 	// https://pkg.go.dev/time#pkg-constants
+	//
+	// Use TimeFormatUnix, TimeFormatUnixMs, TimeFormatUnixMicro or
+	// TimeFormatUnixNano to log the time as an integer since the Unix epoch.
 	TimeFieldFormat string
 
+	// NoTime omits the time field from all logs, eg. when running under
+	// journald or a container runtime which already timestamps each line.
+	NoTime bool
+
 	// TimeFieldName sets the field name for the time field.
 	// Some providers parse and search for different field names.
 	TimeFieldName string
 
+	// DurationFieldName sets the field name for the time it took to serve the
+	// request. Defaults to "elapsed".
+	DurationFieldName string
+
+	// DurationFieldUnit sets how the request duration is logged, one of:
+	// "ms" (default) or "s" for a floating point number of milliseconds or
+	// seconds, "ns" for an integer number of nanoseconds, or "string" for
+	// time.Duration's string format, eg. "12.3ms".
+	DurationFieldUnit string
+
+	// FieldNames renames the fields httplog emits, keyed by their default name,
+	// eg. {"remoteIP": "client_ip", "httpRequest": "req"}. Any of the following
+	// may be renamed: service, version, host, pid, log_schema_version, tags,
+	// httpRequest, requestURL, requestMethod, requestPath, remoteIP, clientIP,
+	// proto, connRequests, connReused, requestID, scheme, tls, tlsVersion,
+	// cipherSuite, serverName, alpn, header, httpResponse, status, bytes, body,
+	// bodyTruncated, bodyContentType, bodySize, requestBody,
+	// requestBodyTruncated, requestBodyContentType, requestBodySize, slow,
+	// sampled, suppressed, statuses, p50, p99, timeout, deadline,
+	// client_disconnected, hijacked, pushed, bytes_in, bytes_out, no_write,
+	// implicit_status, write_error, ttfb, informational, encoding,
+	// uncompressed_bytes, compression_ratio, range, content_range,
+	// content_length, route, requestTrailers, trailers, correlation_id,
+	// parent_id, trace_id, span_id, trace_flags, remotePort (with SemConv),
+	// responseHeader (with FlatFields), error, errorType, errorCauses,
+	// errorRootType, message (of errors with ErrorChains), panic, stacktrace and
+	// the DurationFieldName.
+	FieldNames map[string]string
+
+	// NewHandler, if set, is used to create the slog.Handler writing logs to w
+	// instead of the built-in pretty or JSON handlers, eg. slog.NewTextHandler
+	// or a bridge to another logging library. opts carries the level and
+	// field renaming configured here and should be honored by the handler.
+	// Writer defaults to os.Stdout.
+	NewHandler func(w io.Writer, opts *slog.HandlerOptions) slog.Handler
+
+	// ReplaceAttr, if set, is called to rewrite each attr before it's logged,
+	// see slog.HandlerOptions.ReplaceAttr. It's called after httplog's own
+	// renaming, so the built-in attrs are passed with their configured names,
+	// eg. TimeFieldName, and the time already formatted. Return an empty
+	// slog.Attr to drop the attr.
+	ReplaceAttr func(groups []string, a slog.Attr) slog.Attr
+
+	// Writer is where logs are written to. Defaults to os.Stdout for pretty
+	// output and os.Stderr for JSON output.
+	Writer io.Writer
+
+	// ErrorWriter, if set, is where warn and error level logs are written to
+	// instead of Writer. Eg. set Writer to os.Stdout and ErrorWriter to
+	// os.Stderr to separate the streams.
+	ErrorWriter io.Writer
+
 	// SourceFieldName sets the field name for the source field which logs
 	// the location where the logger was called
 	// its "" if not enabled
 	SourceFieldName string
+
+	// SourceCallerSkip is the number of additional stack frames to skip when
+	// logging the source of the logs written by the middleware which aren't
+	// attributed to a handler. The request and response logs of Handler are
+	// attributed to the next http.Handler in the chain, the function of an
+	// http.HandlerFunc or the ServeHTTP method of other handlers. Other logs,
+	// eg. those of chi's middleware.RequestLogger with a Logger, are
+	// attributed to the first caller outside of httplog.
+	SourceCallerSkip int
+}
+
+// LogSchemaVersion is the version of the layout of the fields httplog emits,
+// logged with Options.SchemaVersion. It's incremented whenever a release
+// renames, moves or changes the type of an existing field.
+//
+// Version 2 logs repeated headers as arrays of their values instead of a
+// "[a], [b]" string. Version 3 logs the stacktrace of panics in JSON as an
+// array of frames with a function, file and line.
+const LogSchemaVersion = 3
+
+// DefaultStaticExtensions are common extensions of static assets, for use as
+// Options.StaticExtensions.
+var DefaultStaticExtensions = []string{
+	".css", ".js", ".map",
+	".png", ".jpg", ".jpeg", ".gif", ".svg", ".webp", ".ico",
+	".woff", ".woff2", ".ttf", ".otf", ".eot",
+}
+
+// DefaultBodyContentTypes are the body content types logged if
+// Options.BodyContentTypes is nil.
+var DefaultBodyContentTypes = []string{
+	"application/json",
+	"application/*+json",
+	"application/xml",
+	"application/*+xml",
+	"application/x-www-form-urlencoded",
+	"text/*",
+}
+
+// logsBody reports whether a body of the given content type is logged,
+// according to BodyContentTypes. Content-Type parameters are ignored.
+func (o *Options) logsBody(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	patterns := o.BodyContentTypes
+	if patterns == nil {
+		patterns = DefaultBodyContentTypes
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), mediaType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// lowerHeaders returns a lower-cased copy of the header names, nil if there
+// are none.
+func lowerHeaders(headers []string) []string {
+	if headers == nil {
+		return nil
+	}
+	lower := make([]string, len(headers))
+	for i, header := range headers {
+		if strings.HasPrefix(header, "~") {
+			// regular expressions are matched case-insensitively as is
+			lower[i] = header
+			continue
+		}
+		lower[i] = strings.ToLower(header)
+	}
+	return lower
+}
+
+// semConvNames are the OpenTelemetry semantic convention names of the fields
+// renamed with Options.SemConv.
+var semConvNames = map[string]string{
+	"service":        "service.name",
+	"version":        "service.version",
+	"host":           "host.name",
+	"pid":            "process.pid",
+	"requestURL":     "url.full",
+	"requestMethod":  "http.request.method",
+	"requestPath":    "url.path",
+	"remoteIP":       "network.peer.address",
+	"remotePort":     "network.peer.port",
+	"clientIP":       "client.address",
+	"scheme":         "url.scheme",
+	"tlsVersion":     "tls.protocol.version",
+	"cipherSuite":    "tls.cipher",
+	"serverName":     "tls.server.name",
+	"alpn":           "tls.next_protocol",
+	"header":         "http.request.header",
+	"responseHeader": "http.response.header",
+	"status":         "http.response.status_code",
+	"bytes":          "http.response.body.size",
+	"route":          "http.route",
+}
+
+// fieldName returns the name of the field named key by default, as renamed
+// by FieldNames or SemConv.
+func (o *Options) fieldName(key string) string {
+	if name, ok := o.FieldNames[key]; ok && name != "" {
+		return name
+	}
+	if name, ok := semConvNames[key]; ok && o.SemConv {
+		return name
+	}
+	return key
+}
+
+// flatFields reports whether the request and response fields are logged at
+// the root, with FlatFields or SemConv.
+func (o *Options) flatFields() bool {
+	return o.FlatFields || o.SemConv
+}
+
+// groupName returns the name of the httpRequest, httpResponse or tls group,
+// which is empty for flat fields so the fields are inlined at the root.
+func (o *Options) groupName(key string) string {
+	if o.flatFields() {
+		return ""
+	}
+	return o.fieldName(key)
+}
+
+// skipPath reports whether requests to p are excluded by SkipPaths or
+// OnlyPaths.
+func (o *Options) skipPath(p string) bool {
+	for _, pattern := range o.SkipPaths {
+		if matchPath(pattern, p) {
+			return true
+		}
+	}
+	if len(o.OnlyPaths) == 0 {
+		return false
+	}
+	for _, pattern := range o.OnlyPaths {
+		if matchPath(pattern, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// skipMethod reports whether requests with method are excluded by
+// SkipMethods.
+func (o *Options) skipMethod(method string) bool {
+	for _, m := range o.SkipMethods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// responseBodyMinStatus returns the minimum status of responses whose body is
+// logged, if it's captured.
+func (o *Options) responseBodyMinStatus() int {
+	switch {
+	case o.LogResponseBody:
+		return 0
+	case o.ResponseBodyMinStatus > 0:
+		return o.ResponseBodyMinStatus
+	}
+	return 400
+}
+
+// staticAsset reports whether p has one of the StaticExtensions.
+func (o *Options) staticAsset(p string) bool {
+	ext := path.Ext(p)
+	if ext == "" {
+		return false
+	}
+	for _, e := range o.StaticExtensions {
+		if strings.EqualFold(strings.TrimPrefix(e, "."), ext[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeLevel returns the level of the most specific RouteLevels pattern
+// matching the request path p.
+func (o *Options) routeLevel(p string) (slog.Level, bool) {
+	best, found := -1, false
+	var level slog.Level
+	for pattern, l := range o.RouteLevels {
+		if !matchPath(pattern, p) {
+			continue
+		}
+		if spec := patternSpecificity(pattern); spec > best {
+			best, found = spec, true
+			level = o.parseLogLevel(l)
+		}
+	}
+	return level, found
+}
+
+// statusLevel returns the level of the response log for status.
+func (o *Options) statusLevel(status int) slog.Level {
+	if level, ok := o.LevelByStatus[status]; ok {
+		return level
+	}
+	if level, ok := o.LevelByStatus[status/100]; ok && status >= 100 {
+		return level
+	}
+	return statusLevel(status)
+}
+
+// Special TimeFieldFormat values to log the time as an integer number of
+// seconds, milliseconds, microseconds or nanoseconds since the Unix epoch.
+const (
+	TimeFormatUnix      = "UNIX"
+	TimeFormatUnixMs    = "UNIX_MS"
+	TimeFormatUnixMicro = "UNIX_MICRO"
+	TimeFormatUnixNano  = "UNIX_NANO"
+)
+
+func isUnixTimeFormat(format string) bool {
+	switch format {
+	case TimeFormatUnix, TimeFormatUnixMs, TimeFormatUnixMicro, TimeFormatUnixNano:
+		return true
+	default:
+		return false
+	}
+}
+
+// timeValue represents t in the given TimeFieldFormat.
+func timeValue(t time.Time, format string) slog.Value {
+	switch format {
+	case TimeFormatUnix:
+		return slog.Int64Value(t.Unix())
+	case TimeFormatUnixMs:
+		return slog.Int64Value(t.UnixMilli())
+	case TimeFormatUnixMicro:
+		return slog.Int64Value(t.UnixMicro())
+	case TimeFormatUnixNano:
+		return slog.Int64Value(t.UnixNano())
+	default:
+		return slog.StringValue(t.Format(format))
+	}
+}
+
+// LevelTrace is a level below slog.LevelDebug for ultra-verbose output which
+// shouldn't show up at debug level. It's enabled with LogLevel "trace".
+const LevelTrace = slog.LevelDebug - 4
+
+// levelName returns the name of level as logged, "TRACE" for LevelTrace and
+// slog's name for all others.
+func levelName(level slog.Level) string {
+	if level == LevelTrace {
+		return "TRACE"
+	}
+	return level.String()
+}
+
+// levelName returns the name of level as logged, taking the custom Levels
+// into account. If several custom names share a level, the alphabetically
+// first one is used.
+func (o *Options) levelName(level slog.Level) string {
+	name := ""
+	for n, l := range o.Levels {
+		if l == level && (name == "" || n < name) {
+			name = n
+		}
+	}
+	if name != "" {
+		return strings.ToUpper(name)
+	}
+	return levelName(level)
 }
 
 // Take the string representation of the log level and turn that into a compatible slog.Level
-// of underlying zerolog pkg and its global logger.
-func parseLogLevel(level string) slog.Level {
+// of underlying slog pkg and its global logger.
+func (o *Options) parseLogLevel(level string) slog.Level {
+	l, ok := o.lookupLogLevel(level)
+	if !ok {
+		return slog.LevelInfo
+	}
+	return l
+}
+
+func (o *Options) lookupLogLevel(level string) (slog.Level, bool) {
+	if l, ok := o.Levels[level]; ok {
+		return l, true
+	}
 	switch level {
+	case "trace":
+		return LevelTrace, true
 	case "debug":
-		return slog.LevelDebug
+		return slog.LevelDebug, true
 	case "info":
-		return slog.LevelInfo
+		return slog.LevelInfo, true
 	case "warn":
-		return slog.LevelWarn
+		return slog.LevelWarn, true
 	case "error":
-		return slog.LevelError
+		return slog.LevelError, true
 	default:
-		return slog.LevelInfo
+		return slog.LevelInfo, false
 	}
 }
 
-// Configure will set new global/default options for the httplog and behaviour
-// of underlying zerolog pkg and its global logger.
-func Configure(opts Options) {
+// Validate reports mistakes in the options which Configure would otherwise
+// silently mask with defaults. Empty values are valid and mean "use the
+// default".
+func (o Options) Validate() error {
+	var errs []error
+
+	if o.LogLevel != "" {
+		if _, ok := o.lookupLogLevel(o.LogLevel); !ok {
+			errs = append(errs, fmt.Errorf("httplog: unknown LogLevel %q", o.LogLevel))
+		}
+	}
+
+	if o.TimeFieldFormat != "" && !isUnixTimeFormat(o.TimeFieldFormat) {
+		// A layout without any time elements formats every time the same way.
+		t1 := time.Date(2001, 2, 3, 4, 5, 6, 7, time.UTC)
+		t2 := time.Date(2012, 11, 10, 9, 8, 7, 6, time.FixedZone("", 3600))
+		if t1.Format(o.TimeFieldFormat) == t2.Format(o.TimeFieldFormat) {
+			errs = append(errs, fmt.Errorf("httplog: TimeFieldFormat %q has no time elements", o.TimeFieldFormat))
+		}
+	}
+
+	if o.StartLevel != "" {
+		if _, ok := o.lookupLogLevel(o.StartLevel); !ok {
+			errs = append(errs, fmt.Errorf("httplog: unknown StartLevel %q", o.StartLevel))
+		}
+	}
+
+	for _, pattern := range o.SkipPaths {
+		if err := validPathPattern(pattern); err != nil {
+			errs = append(errs, fmt.Errorf("httplog: malformed SkipPaths pattern %q: %w", pattern, err))
+		}
+	}
+	for _, pattern := range o.OnlyPaths {
+		if err := validPathPattern(pattern); err != nil {
+			errs = append(errs, fmt.Errorf("httplog: malformed OnlyPaths pattern %q: %w", pattern, err))
+		}
+	}
+
+	for pattern, level := range o.RouteLevels {
+		if err := validPathPattern(pattern); err != nil {
+			errs = append(errs, fmt.Errorf("httplog: malformed RouteLevels pattern %q: %w", pattern, err))
+		}
+		if _, ok := o.lookupLogLevel(level); !ok {
+			errs = append(errs, fmt.Errorf("httplog: unknown RouteLevels level %q for %q", level, pattern))
+		}
+	}
+
+	if o.SlowRequestThreshold < 0 || o.SlowRequestErrorThreshold < 0 {
+		errs = append(errs, errors.New("httplog: negative slow request threshold"))
+	}
+	if o.SlowRequestThreshold > 0 && o.SlowRequestErrorThreshold > 0 && o.SlowRequestErrorThreshold < o.SlowRequestThreshold {
+		errs = append(errs, errors.New("httplog: SlowRequestErrorThreshold is below SlowRequestThreshold"))
+	}
+
+	if o.FloodLimit < 0 {
+		errs = append(errs, errors.New("httplog: negative FloodLimit"))
+	}
+
+	if o.RouteRateLimit < 0 {
+		errs = append(errs, errors.New("httplog: negative RouteRateLimit"))
+	}
+
+	if o.SampleRate < 0 || o.SampleRate > 1 {
+		errs = append(errs, fmt.Errorf("httplog: SampleRate %v is not between 0 and 1", o.SampleRate))
+	}
+
+	if o.TailLatency < 0 {
+		errs = append(errs, errors.New("httplog: negative TailLatency"))
+	}
+
+	for status := range o.LevelByStatus {
+		if (status < 1 || status > 5) && (status < 100 || status > 999) {
+			errs = append(errs, fmt.Errorf("httplog: invalid LevelByStatus status %d", status))
+		}
+	}
+
+	if o.ResponseBodyMinStatus < 0 || o.ResponseBodyMinStatus > 999 {
+		errs = append(errs, fmt.Errorf("httplog: invalid ResponseBodyMinStatus %d", o.ResponseBodyMinStatus))
+	}
+
+	if o.BodyMaxBytes < 0 {
+		errs = append(errs, fmt.Errorf("httplog: negative BodyMaxBytes %d", o.BodyMaxBytes))
+	}
+
+	switch o.DurationFieldUnit {
+	case "", "ms", "s", "ns", "string":
+	default:
+		errs = append(errs, fmt.Errorf("httplog: unknown DurationFieldUnit %q", o.DurationFieldUnit))
+	}
+
+	if o.QuietDownPeriod < 0 {
+		errs = append(errs, fmt.Errorf("httplog: negative QuietDownPeriod %s", o.QuietDownPeriod))
+	}
+	for _, entry := range o.QuietDownRoutes {
+		if err := validPathPattern(parseQuietRule(entry).route); err != nil {
+			errs = append(errs, fmt.Errorf("httplog: malformed QuietDownRoutes pattern %q: %w", entry, err))
+		}
+	}
+	if o.QuietDownSampleEvery < 0 {
+		errs = append(errs, fmt.Errorf("httplog: negative QuietDownSampleEvery %d", o.QuietDownSampleEvery))
+	}
+	if o.QuietDownPeriod > 0 && len(o.QuietDownRoutes) == 0 {
+		errs = append(errs, errors.New("httplog: QuietDownPeriod is set without any QuietDownRoutes"))
+	}
+
+	switch o.CookieLogging {
+	case "", "redact", "omit", "names":
+	default:
+		errs = append(errs, fmt.Errorf("httplog: unknown CookieLogging %q", o.CookieLogging))
+	}
+
+	for _, headers := range []struct {
+		option string
+		list   []string
+	}{{"SkipHeaders", o.SkipHeaders}, {"OnlyHeaders", o.OnlyHeaders}, {"LogResponseHeaders", o.LogResponseHeaders}} {
+		for _, header := range headers.list {
+			if strings.TrimSpace(header) == "" {
+				errs = append(errs, fmt.Errorf("httplog: empty header name in %s", headers.option))
+			} else if err := validHeaderPattern(header); err != nil {
+				errs = append(errs, fmt.Errorf("httplog: invalid %s pattern %q: %w", headers.option, header, err))
+			}
+		}
+	}
+
+	for _, pattern := range o.BodyContentTypes {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("httplog: invalid BodyContentTypes pattern %q: %w", pattern, err))
+		}
+	}
+
+	for _, name := range o.Masks {
+		if _, ok := BuiltinMasks[name]; !ok {
+			errs = append(errs, fmt.Errorf("httplog: unknown mask %q", name))
+		}
+	}
+	for _, rule := range o.MaskRules {
+		if rule.Pattern == nil {
+			errs = append(errs, errors.New("httplog: MaskRule without a Pattern"))
+			break
+		}
+	}
+
+	switch o.OTelSpan {
+	case "", "attributes", "event":
+	default:
+		errs = append(errs, fmt.Errorf("httplog: unknown OTelSpan %q", o.OTelSpan))
+	}
+
+	for _, rule := range o.PathRules {
+		if rule.Pattern == nil {
+			errs = append(errs, errors.New("httplog: PathRule without a Pattern"))
+			break
+		}
+	}
+
+	for _, proxy := range o.TrustedProxies {
+		if _, err := parseProxy(proxy); err != nil {
+			errs = append(errs, fmt.Errorf("httplog: invalid TrustedProxies entry: %w", err))
+		}
+	}
+
+	for _, name := range o.TracePropagators {
+		if _, ok := propagators[name]; !ok {
+			errs = append(errs, fmt.Errorf("httplog: unknown trace propagator %q", name))
+		}
+	}
+
+	for _, p := range o.RedactJSONPaths {
+		if p == "" || strings.HasPrefix(p, ".") || strings.HasSuffix(p, ".") || strings.Contains(p, "..") {
+			errs = append(errs, fmt.Errorf("httplog: invalid RedactJSONPaths path %q", p))
+		}
+	}
+
+	fieldNames := map[string]string{}
+	for _, f := range []struct{ option, name string }{
+		{"LevelFieldName", o.LevelFieldName},
+		{"MessageFieldName", o.MessageFieldName},
+		{"TimeFieldName", o.TimeFieldName},
+		{"SourceFieldName", o.SourceFieldName},
+	} {
+		if f.name == "" {
+			continue
+		}
+		if other, ok := fieldNames[f.name]; ok {
+			errs = append(errs, fmt.Errorf("httplog: %s and %s are both set to %q", other, f.option, f.name))
+			continue
+		}
+		fieldNames[f.name] = f.option
+	}
+
+	return errors.Join(errs...)
+}
+
+// ConfigureE is like Configure, but returns an error instead of configuring
+// anything if the options are invalid. The configured logger is the slog
+// default logger afterwards.
+func ConfigureE(opts Options) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	Configure(opts)
+	return nil
+}
+
+// Configure sets the global slog default logger to one configured with opts.
+// It is safe to call at any time, including while requests are being served.
+// It returns the logger, so it can be passed on explicitly instead of relying
+// on the global default, along with the options as resolved with defaults.
+//
+// NOTE: Configure does not modify DefaultOptions, which are only the starting
+// point for NewLogger, OptionsFromEnv and LoadConfig.
+func Configure(opts Options) (*slog.Logger, Options) {
+	defaultLogger.Configure(opts)
+	slog.SetDefault(defaultLogger.Logger)
+	return defaultLogger.Logger, defaultLogger.Options()
+}
+
+// defaultLogger backs the global slog default logger set up by Configure.
+var defaultLogger = &Logger{}
+
+// SetLevel changes the minimum level of the global logger set up by
+// Configure, taking effect immediately.
+func SetLevel(level slog.Level) {
+	defaultLogger.SetLevel(level)
+}
+
+// SetLevel changes the minimum level of the logger, taking effect immediately
+// for all loggers derived from it. It's reset by Configure.
+func (l *Logger) SetLevel(level slog.Level) {
+	l.level.Set(level)
+}
+
+// Configure sets new options for the logger, leaving the global slog default
+// logger untouched. It is safe to call while the logger is in use: requests
+// already in flight finish with the options they started with, while log
+// lines are written with the new handler from then on, including those of
+// loggers derived from l with With or WithGroup.
+func (l *Logger) Configure(opts Options) {
 	// if opts.LogLevel is not set
 	// it would be 0 which is LevelInfo
 
@@ -101,6 +1055,10 @@ func Configure(opts Options) {
 		opts.LevelFieldName = "level"
 	}
 
+	if opts.MessageFieldName == "" {
+		opts.MessageFieldName = slog.MessageKey
+	}
+
 	if opts.TimeFieldFormat == "" {
 		opts.TimeFieldFormat = time.RFC3339Nano
 	}
@@ -109,48 +1067,159 @@ func Configure(opts Options) {
 		opts.TimeFieldName = "timestamp"
 	}
 
+	if opts.BodyMaxBytes <= 0 {
+		opts.BodyMaxBytes = 512
+	}
+
+	if opts.StartLevel == "" {
+		opts.StartLevel = "info"
+	}
+
+	if opts.RequestIDHeader == "" {
+		opts.RequestIDHeader = "X-Request-Id"
+	}
+
+	if opts.DurationFieldName == "" {
+		opts.DurationFieldName = "elapsed"
+	}
+
+	if opts.DurationFieldUnit == "" {
+		opts.DurationFieldUnit = "ms"
+	}
+
 	if len(opts.QuietDownRoutes) > 0 {
 		if opts.QuietDownPeriod == 0 {
 			opts.QuietDownPeriod = 5 * time.Minute
 		}
 	}
 
-	// Pre-downcase all SkipHeaders
-	for i, header := range opts.SkipHeaders {
-		opts.SkipHeaders[i] = strings.ToLower(header)
-	}
+	// Pre-downcase all header lists, in a copy as the slices may be shared
+	// with the caller or DefaultOptions
+	opts.SkipHeaders = lowerHeaders(opts.SkipHeaders)
+	opts.OnlyHeaders = lowerHeaders(opts.OnlyHeaders)
+	opts.LogResponseHeaders = lowerHeaders(opts.LogResponseHeaders)
 
-	DefaultOptions = opts
+	// Parse the trusted proxies once rather than for every request
+	opts.trustedProxies = parseProxies(opts.TrustedProxies)
 
 	var addSource bool
 	if opts.SourceFieldName != "" {
 		addSource = true
 	}
 
-	replaceAttrs := func(_ []string, a slog.Attr) slog.Attr {
-		switch a.Key {
-		case slog.LevelKey:
-			a.Key = opts.LevelFieldName
-		case slog.TimeKey:
-			a.Key = opts.TimeFieldName
-			a.Value = slog.StringValue(a.Value.Time().Format(opts.TimeFieldFormat))
-		case slog.SourceKey:
-			if opts.SourceFieldName != "" {
-				a.Key = opts.SourceFieldName
+	replaceAttrs := func(groups []string, a slog.Attr) slog.Attr {
+		// The built-in attrs are never in a group
+		if len(groups) == 0 {
+			switch a.Key {
+			case slog.LevelKey:
+				a.Key = opts.LevelFieldName
+				if level, ok := a.Value.Any().(slog.Level); ok {
+					a.Value = slog.StringValue(opts.levelName(level))
+				}
+			case slog.MessageKey:
+				a.Key = opts.MessageFieldName
+			case slog.TimeKey:
+				if opts.NoTime {
+					return slog.Attr{}
+				}
+				a.Key = opts.TimeFieldName
+				if a.Value.Kind() == slog.KindTime {
+					a.Value = timeValue(a.Value.Time(), opts.TimeFieldFormat)
+				}
+			case slog.SourceKey:
+				if opts.SourceFieldName != "" {
+					a.Key = opts.SourceFieldName
+				}
 			}
 		}
+		if err, ok := a.Value.Any().(error); ok && opts.ErrorChains && a.Value.Kind() == slog.KindAny {
+			a.Value = slog.GroupValue(append([]slog.Attr{slog.String(opts.fieldName("message"), err.Error())},
+				errorChainAttrs(err, &opts)...)...)
+		}
+		if opts.ReplaceAttr != nil {
+			a = opts.ReplaceAttr(groups, a)
+		}
 		return a
 	}
 
+	l.level.Set(opts.parseLogLevel(opts.LogLevel))
 	handlerOpts := &slog.HandlerOptions{
-		Level:       parseLogLevel(opts.LogLevel),
+		Level:       &l.level,
 		ReplaceAttr: replaceAttrs,
 		AddSource:   addSource,
 	}
 
-	if !opts.JSON {
-		slog.SetDefault(slog.New(NewPrettyHandler(os.Stdout, handlerOpts)))
-	} else {
-		slog.SetDefault(slog.New(handlerOpts.NewJSONHandler(os.Stderr)))
+	newHandler := func(w io.Writer) slog.Handler {
+		if opts.NewHandler != nil {
+			if w == nil {
+				w = os.Stdout
+			}
+			return opts.NewHandler(w, handlerOpts)
+		}
+		if !opts.JSON {
+			if w == nil {
+				w = os.Stdout
+			}
+			return NewPrettyHandler(w, handlerOpts)
+		}
+		if w == nil {
+			w = os.Stderr
+		}
+		return slog.NewJSONHandler(w, handlerOpts)
+	}
+
+	handler := newHandler(opts.Writer)
+	if opts.ErrorWriter != nil {
+		handler = &levelSplitHandler{
+			level: slog.LevelWarn,
+			low:   handler,
+			high:  newHandler(opts.ErrorWriter),
+		}
+	}
+
+	serviceName := opts.ServiceName
+	if serviceName == "" {
+		serviceName = l.serviceName
+	}
+	if serviceName != "" {
+		handler = handler.WithAttrs([]slog.Attr{{Key: opts.fieldName("service"), Value: slog.StringValue(serviceName)}})
+		if !opts.Concise && len(opts.Tags) > 0 {
+			group := []slog.Attr{}
+			for k, v := range opts.Tags {
+				group = append(group, slog.Attr{Key: k, Value: slog.StringValue(v)})
+			}
+			handler = handler.WithAttrs([]slog.Attr{{Key: opts.fieldName("tags"), Value: slog.GroupValue(group...)}})
+		}
 	}
+	if opts.ServiceVersion != "" {
+		handler = handler.WithAttrs([]slog.Attr{slog.String(opts.fieldName("version"), opts.ServiceVersion)})
+	}
+	if opts.IncludeHostInfo {
+		hostname, _ := os.Hostname()
+		handler = handler.WithAttrs([]slog.Attr{
+			slog.String(opts.fieldName("host"), hostname),
+			slog.Int(opts.fieldName("pid"), os.Getpid()),
+		})
+	}
+	if opts.SchemaVersion {
+		handler = handler.WithAttrs([]slog.Attr{slog.Int(opts.fieldName("log_schema_version"), LogSchemaVersion)})
+	}
+	if len(opts.Attrs) > 0 {
+		handler = handler.WithAttrs(opts.Attrs)
+	}
+
+	if opts.FloodLimit > 0 {
+		handler = &floodHandler{state: &l.flood, limit: opts.FloodLimit, root: handler, handler: handler}
+	}
+
+	l.opts.Store(&opts)
+	l.init.Do(func() {
+		l.handler = newSwapHandler(handler)
+		l.Logger = slog.New(l.handler)
+	})
+	l.handler.swap(handler)
+
+	l.quiet.setPersister(opts.QuietDownPersister, func(err error) {
+		l.Logger.Warn(fmt.Sprintf("httplog: quiet-down state: %v", err))
+	})
 }
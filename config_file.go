@@ -0,0 +1,328 @@
+package httplog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configFile is the on-disk representation of Options. Fields are pointers
+// so that settings missing from the file keep their default.
+type configFile struct {
+	LogLevel                  *string               `json:"logLevel" yaml:"logLevel"`
+	LevelFieldName            *string               `json:"levelFieldName" yaml:"levelFieldName"`
+	MessageFieldName          *string               `json:"messageFieldName" yaml:"messageFieldName"`
+	JSON                      *bool                 `json:"json" yaml:"json"`
+	Concise                   *bool                 `json:"concise" yaml:"concise"`
+	SingleLine                *bool                 `json:"singleLine" yaml:"singleLine"`
+	TailBuffering             *bool                 `json:"tailBuffering" yaml:"tailBuffering"`
+	TailLatency               *string               `json:"tailLatency" yaml:"tailLatency"`
+	TailDebugHeader           *string               `json:"tailDebugHeader" yaml:"tailDebugHeader"`
+	StartLevel                *string               `json:"startLevel" yaml:"startLevel"`
+	SemConv                   *bool                 `json:"semConv" yaml:"semConv"`
+	ServiceName               *string               `json:"serviceName" yaml:"serviceName"`
+	ServiceVersion            *string               `json:"serviceVersion" yaml:"serviceVersion"`
+	IncludeHostInfo           *bool                 `json:"includeHostInfo" yaml:"includeHostInfo"`
+	LogRequestBody            *bool                 `json:"logRequestBody" yaml:"logRequestBody"`
+	LogResponseBody           *bool                 `json:"logResponseBody" yaml:"logResponseBody"`
+	LogBandwidth              *bool                 `json:"logBandwidth" yaml:"logBandwidth"`
+	BodyMaxBytes              *int                  `json:"bodyMaxBytes" yaml:"bodyMaxBytes"`
+	ResponseBodyMinStatus     *int                  `json:"responseBodyMinStatus" yaml:"responseBodyMinStatus"`
+	BodyContentTypes          []string              `json:"bodyContentTypes" yaml:"bodyContentTypes"`
+	RedactJSONPaths           []string              `json:"redactJSONPaths" yaml:"redactJSONPaths"`
+	RedactQueryParams         []string              `json:"redactQueryParams" yaml:"redactQueryParams"`
+	NormalizePaths            *bool                 `json:"normalizePaths" yaml:"normalizePaths"`
+	TrustedProxies            []string              `json:"trustedProxies" yaml:"trustedProxies"`
+	TracePropagators          []string              `json:"tracePropagators" yaml:"tracePropagators"`
+	OTelSpan                  *string               `json:"otelSpan" yaml:"otelSpan"`
+	Masks                     []string              `json:"masks" yaml:"masks"`
+	Tags                      map[string]string     `json:"tags" yaml:"tags"`
+	FieldNames                map[string]string     `json:"fieldNames" yaml:"fieldNames"`
+	RouteLevels               map[string]string     `json:"routeLevels" yaml:"routeLevels"`
+	Levels                    map[string]slog.Level `json:"levels" yaml:"levels"`
+	LevelByStatus             map[int]slog.Level    `json:"levelByStatus" yaml:"levelByStatus"`
+	RequestIDHeader           *string               `json:"requestIDHeader" yaml:"requestIDHeader"`
+	CorrelationIDHeader       *string               `json:"correlationIDHeader" yaml:"correlationIDHeader"`
+	ParentIDHeader            *string               `json:"parentIDHeader" yaml:"parentIDHeader"`
+	EchoRequestID             *bool                 `json:"echoRequestID" yaml:"echoRequestID"`
+	AuthFingerprint           *bool                 `json:"authFingerprint" yaml:"authFingerprint"`
+	CookieLogging             *string               `json:"cookieLogging" yaml:"cookieLogging"`
+	SafeCookies               []string              `json:"safeCookies" yaml:"safeCookies"`
+	SkipPaths                 []string              `json:"skipPaths" yaml:"skipPaths"`
+	OnlyPaths                 []string              `json:"onlyPaths" yaml:"onlyPaths"`
+	SkipMethods               []string              `json:"skipMethods" yaml:"skipMethods"`
+	StaticExtensions          []string              `json:"staticExtensions" yaml:"staticExtensions"`
+	LogHealthChecks           *bool                 `json:"logHealthChecks" yaml:"logHealthChecks"`
+	SkipHeaders               []string              `json:"skipHeaders" yaml:"skipHeaders"`
+	OnlyHeaders               []string              `json:"onlyHeaders" yaml:"onlyHeaders"`
+	LogResponseHeaders        []string              `json:"logResponseHeaders" yaml:"logResponseHeaders"`
+	SampleRate                *float64              `json:"sampleRate" yaml:"sampleRate"`
+	RouteRateLimit            *float64              `json:"routeRateLimit" yaml:"routeRateLimit"`
+	FloodLimit                *int                  `json:"floodLimit" yaml:"floodLimit"`
+	SuppressErrors            *bool                 `json:"suppressErrors" yaml:"suppressErrors"`
+	QuietDownRoutes           []string              `json:"quietDownRoutes" yaml:"quietDownRoutes"`
+	SlowRequestThreshold      *string               `json:"slowRequestThreshold" yaml:"slowRequestThreshold"`
+	SlowRequestErrorThreshold *string               `json:"slowRequestErrorThreshold" yaml:"slowRequestErrorThreshold"`
+	QuietDownSampleEvery      *int                  `json:"quietDownSampleEvery" yaml:"quietDownSampleEvery"`
+	QuietDownOnlySuccess      *bool                 `json:"quietDownOnlySuccess" yaml:"quietDownOnlySuccess"`
+	QuietDownFile             *string               `json:"quietDownFile" yaml:"quietDownFile"`
+	QuietDownPeriod           *string               `json:"quietDownPeriod" yaml:"quietDownPeriod"`
+	TimeFieldFormat           *string               `json:"timeFieldFormat" yaml:"timeFieldFormat"`
+	NoTime                    *bool                 `json:"noTime" yaml:"noTime"`
+	TimeFieldName             *string               `json:"timeFieldName" yaml:"timeFieldName"`
+	SourceFieldName           *string               `json:"sourceFieldName" yaml:"sourceFieldName"`
+	DurationFieldName         *string               `json:"durationFieldName" yaml:"durationFieldName"`
+	DurationFieldUnit         *string               `json:"durationFieldUnit" yaml:"durationFieldUnit"`
+}
+
+// LoadConfig reads Options from a JSON or YAML file, chosen by the file
+// extension (.json, .yaml or .yml). Settings missing from the file keep the
+// value of DefaultOptions. Durations are written as strings accepted by
+// time.ParseDuration, eg. "5m". The resulting options are checked with
+// Options.Validate.
+//
+// Custom Levels are written as slog level names, eg. "ERROR+4".
+//
+// An example YAML config:
+//
+//	logLevel: debug
+//	json: true
+//	skipHeaders: [x-api-key]
+//	quietDownRoutes: [/ping]
+//	quietDownPeriod: 1m
+func LoadConfig(path string) (Options, error) {
+	return loadConfig(path, DefaultOptions)
+}
+
+// loadConfig loads the config file at path like LoadConfig, on top of base.
+func loadConfig(path string, base Options) (Options, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Options{}, fmt.Errorf("httplog: %w", err)
+	}
+
+	var cfg configFile
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&cfg)
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&cfg)
+	default:
+		return Options{}, fmt.Errorf("httplog: unsupported config file extension %q", ext)
+	}
+	if err != nil {
+		return Options{}, fmt.Errorf("httplog: parsing %s: %w", path, err)
+	}
+
+	opts, err := cfg.options(base)
+	if err != nil {
+		return Options{}, fmt.Errorf("httplog: parsing %s: %w", path, err)
+	}
+	if err := opts.Validate(); err != nil {
+		return Options{}, err
+	}
+	return opts, nil
+}
+
+func (c *configFile) options(base Options) (Options, error) {
+	opts := base.Clone()
+
+	setIf(&opts.LogLevel, c.LogLevel)
+	setIf(&opts.LevelFieldName, c.LevelFieldName)
+	setIf(&opts.MessageFieldName, c.MessageFieldName)
+	setIf(&opts.JSON, c.JSON)
+	setIf(&opts.Concise, c.Concise)
+	setIf(&opts.SingleLine, c.SingleLine)
+	setIf(&opts.TailBuffering, c.TailBuffering)
+	setIf(&opts.TailDebugHeader, c.TailDebugHeader)
+	setIf(&opts.StartLevel, c.StartLevel)
+	setIf(&opts.SemConv, c.SemConv)
+	setIf(&opts.ServiceName, c.ServiceName)
+	setIf(&opts.ServiceVersion, c.ServiceVersion)
+	setIf(&opts.IncludeHostInfo, c.IncludeHostInfo)
+	setIf(&opts.LogRequestBody, c.LogRequestBody)
+	setIf(&opts.LogResponseBody, c.LogResponseBody)
+	setIf(&opts.LogBandwidth, c.LogBandwidth)
+	setIf(&opts.BodyMaxBytes, c.BodyMaxBytes)
+	setIf(&opts.ResponseBodyMinStatus, c.ResponseBodyMinStatus)
+	setIf(&opts.NormalizePaths, c.NormalizePaths)
+	setIf(&opts.OTelSpan, c.OTelSpan)
+	setIf(&opts.RequestIDHeader, c.RequestIDHeader)
+	setIf(&opts.CorrelationIDHeader, c.CorrelationIDHeader)
+	setIf(&opts.ParentIDHeader, c.ParentIDHeader)
+	setIf(&opts.EchoRequestID, c.EchoRequestID)
+	setIf(&opts.AuthFingerprint, c.AuthFingerprint)
+	setIf(&opts.CookieLogging, c.CookieLogging)
+	setIf(&opts.SampleRate, c.SampleRate)
+	setIf(&opts.RouteRateLimit, c.RouteRateLimit)
+	setIf(&opts.FloodLimit, c.FloodLimit)
+	setIf(&opts.SuppressErrors, c.SuppressErrors)
+	setIf(&opts.LogHealthChecks, c.LogHealthChecks)
+	setIf(&opts.QuietDownSampleEvery, c.QuietDownSampleEvery)
+	setIf(&opts.QuietDownOnlySuccess, c.QuietDownOnlySuccess)
+	setIf(&opts.TimeFieldFormat, c.TimeFieldFormat)
+	setIf(&opts.NoTime, c.NoTime)
+	setIf(&opts.TimeFieldName, c.TimeFieldName)
+	setIf(&opts.SourceFieldName, c.SourceFieldName)
+	setIf(&opts.DurationFieldName, c.DurationFieldName)
+	setIf(&opts.DurationFieldUnit, c.DurationFieldUnit)
+
+	if c.Tags != nil {
+		opts.Tags = c.Tags
+	}
+	if c.Levels != nil {
+		opts.Levels = c.Levels
+	}
+	if c.LevelByStatus != nil {
+		opts.LevelByStatus = c.LevelByStatus
+	}
+	if c.RouteLevels != nil {
+		opts.RouteLevels = c.RouteLevels
+	}
+	if c.FieldNames != nil {
+		opts.FieldNames = c.FieldNames
+	}
+	if c.BodyContentTypes != nil {
+		opts.BodyContentTypes = c.BodyContentTypes
+	}
+	if c.RedactJSONPaths != nil {
+		opts.RedactJSONPaths = c.RedactJSONPaths
+	}
+	if c.RedactQueryParams != nil {
+		opts.RedactQueryParams = c.RedactQueryParams
+	}
+	if c.TrustedProxies != nil {
+		opts.TrustedProxies = c.TrustedProxies
+	}
+	if c.TracePropagators != nil {
+		opts.TracePropagators = c.TracePropagators
+	}
+	if c.Masks != nil {
+		opts.Masks = c.Masks
+	}
+	if c.SafeCookies != nil {
+		opts.SafeCookies = c.SafeCookies
+	}
+	if c.SkipPaths != nil {
+		opts.SkipPaths = c.SkipPaths
+	}
+	if c.OnlyPaths != nil {
+		opts.OnlyPaths = c.OnlyPaths
+	}
+	if c.SkipMethods != nil {
+		opts.SkipMethods = c.SkipMethods
+	}
+	if c.StaticExtensions != nil {
+		opts.StaticExtensions = c.StaticExtensions
+	}
+	if c.SkipHeaders != nil {
+		opts.SkipHeaders = c.SkipHeaders
+	}
+	if c.OnlyHeaders != nil {
+		opts.OnlyHeaders = c.OnlyHeaders
+	}
+	if c.LogResponseHeaders != nil {
+		opts.LogResponseHeaders = c.LogResponseHeaders
+	}
+	if c.QuietDownFile != nil {
+		opts.QuietDownPersister = QuietDownFile(*c.QuietDownFile)
+	}
+	if c.QuietDownRoutes != nil {
+		opts.QuietDownRoutes = c.QuietDownRoutes
+	}
+	for _, d := range []struct {
+		name  string
+		value *string
+		dst   *time.Duration
+	}{
+		{"quietDownPeriod", c.QuietDownPeriod, &opts.QuietDownPeriod},
+		{"slowRequestThreshold", c.SlowRequestThreshold, &opts.SlowRequestThreshold},
+		{"slowRequestErrorThreshold", c.SlowRequestErrorThreshold, &opts.SlowRequestErrorThreshold},
+		{"tailLatency", c.TailLatency, &opts.TailLatency},
+	} {
+		if d.value != nil {
+			v, err := time.ParseDuration(*d.value)
+			if err != nil {
+				return Options{}, fmt.Errorf("%s: %w", d.name, err)
+			}
+			*d.dst = v
+		}
+	}
+	return opts, nil
+}
+
+func setIf[T any](dst *T, v *T) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+// WatchConfig loads the config file at path and applies it to the logger,
+// at once and every time the file changes, checking its modification time
+// and size every interval (one second if zero). It blocks until ctx is done,
+// so it's usually run in its own goroutine:
+//
+//	go logger.WatchConfig(ctx, "httplog.yaml", 0, func(err error) { log.Print(err) })
+//
+// The file is applied on top of the options the logger had when WatchConfig
+// was called, rather than DefaultOptions as with LoadConfig. A reload only
+// changes the fields the file sets, those the file can't set, eg. Writer,
+// NewHandler, ReplaceAttr or the funcs such as Skip, are kept as configured
+// in code, and a field removed from the file reverts to that configuration.
+//
+// A file which fails to load leaves the current configuration in place and
+// is reported to onError, if not nil.
+func (l *Logger) WatchConfig(ctx context.Context, path string, interval time.Duration, onError func(error)) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	base := l.Options()
+
+	var lastMod time.Time
+	var lastSize int64 = -1
+	var statFailed bool
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		fi, err := os.Stat(path)
+		if err != nil {
+			// Only report the first failure, the file is likely being replaced
+			// or has gone away for good.
+			if !statFailed && onError != nil {
+				onError(fmt.Errorf("httplog: %w", err))
+			}
+			statFailed = true
+		} else if statFailed || !fi.ModTime().Equal(lastMod) || fi.Size() != lastSize {
+			statFailed = false
+			lastMod, lastSize = fi.ModTime(), fi.Size()
+			opts, err := loadConfig(path, base)
+			if err != nil {
+				if onError != nil {
+					onError(err)
+				}
+			} else {
+				l.Configure(opts)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
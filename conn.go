@@ -0,0 +1,40 @@
+package httplog
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// connState tracks the requests served on a connection.
+type connState struct {
+	requests atomic.Int64
+}
+
+// ConnContext is an http.Server.ConnContext hook letting the middleware tell
+// whether a request reused a keep-alive or HTTP/2 connection. With it, the
+// connRequests and connReused fields are logged:
+//
+//	srv := &http.Server{Handler: r, ConnContext: httplog.ConnContext}
+//
+// When chaining with another hook, call it from there.
+func ConnContext(ctx context.Context, _ net.Conn) context.Context {
+	return context.WithValue(ctx, connStateCtxKey, &connState{})
+}
+
+// countConnRequest counts r on its connection, if ConnContext is installed.
+func countConnRequest(r *http.Request) {
+	if state, ok := r.Context().Value(connStateCtxKey).(*connState); ok {
+		state.requests.Add(1)
+	}
+}
+
+// connRequests returns the number of requests served on the connection of r
+// so far, zero if unknown.
+func connRequests(r *http.Request) int64 {
+	if state, ok := r.Context().Value(connStateCtxKey).(*connState); ok {
+		return state.requests.Load()
+	}
+	return 0
+}
@@ -0,0 +1,137 @@
+package httplog
+
+import (
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// traceContext identifies the span of a distributed trace a request is part
+// of, as propagated by the caller.
+type traceContext struct {
+	traceID string
+	spanID  string
+	flags   string
+}
+
+// propagators extract the trace context of a request from its headers, by
+// the names used in Options.TracePropagators.
+var propagators = map[string]func(http.Header) (traceContext, bool){
+	"tracecontext": parseTraceparent,
+	"b3":           parseB3Single,
+	"b3multi":      parseB3Multi,
+}
+
+// correlationLogFields returns the fields correlating the request with the
+// calls around it, logged on every line of the request.
+func correlationLogFields(r *http.Request, opts *Options) []slog.Attr {
+	var fields []slog.Attr
+
+	if opts.CorrelationIDHeader != "" {
+		// Without an incoming correlation ID this service starts the chain.
+		correlationID := r.Header.Get(opts.CorrelationIDHeader)
+		if !validRequestID(correlationID) {
+			correlationID = GetRequestID(r.Context())
+		}
+		if correlationID != "" {
+			fields = append(fields, slog.String(opts.fieldName("correlation_id"), correlationID))
+		}
+	}
+	if opts.ParentIDHeader != "" {
+		if parentID := r.Header.Get(opts.ParentIDHeader); validRequestID(parentID) {
+			fields = append(fields, slog.String(opts.fieldName("parent_id"), parentID))
+		}
+	}
+
+	// An active OpenTelemetry span takes precedence, its context was already
+	// extracted from the headers by the tracing middleware.
+	tc, ok := spanTraceContext(r.Context())
+	for _, name := range opts.TracePropagators {
+		if ok {
+			break
+		}
+		if parse, known := propagators[name]; known {
+			tc, ok = parse(r.Header)
+		}
+	}
+	if ok {
+		fields = append(fields,
+			slog.String(opts.fieldName("trace_id"), tc.traceID),
+			slog.String(opts.fieldName("span_id"), tc.spanID),
+			slog.String(opts.fieldName("trace_flags"), tc.flags))
+	}
+	return fields
+}
+
+// parseTraceparent parses the W3C Trace Context traceparent header, eg.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func parseTraceparent(header http.Header) (traceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(header.Get("Traceparent")), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return traceContext{}, false
+	}
+	// later versions may append fields, but version 00 has exactly four
+	if parts[0] == "00" && len(parts) != 4 {
+		return traceContext{}, false
+	}
+	tc := traceContext{traceID: parts[1], spanID: parts[2], flags: parts[3]}
+	if !isHex(parts[0], 2) || !isHexID(tc.traceID, 32) || !isHexID(tc.spanID, 16) || !isHex(tc.flags, 2) {
+		return traceContext{}, false
+	}
+	return tc, true
+}
+
+// isHex reports whether s is n lower-case hex digits.
+func isHex(s string, n int) bool {
+	if len(s) != n || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// isHexID reports whether id is a valid trace or span ID of n hex digits,
+// which mustn't be all zero.
+func isHexID(id string, n int) bool {
+	return isHex(id, n) && strings.Trim(id, "0") != ""
+}
+
+// parseB3Single parses the single b3 header of Zipkin's B3 propagation, eg.
+// "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1-05e3ac9a4f6e3b90".
+func parseB3Single(header http.Header) (traceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(header.Get("B3")), "-")
+	if len(parts) < 2 {
+		// a lone sampling state such as "0" carries no trace
+		return traceContext{}, false
+	}
+	var sampled string
+	if len(parts) > 2 {
+		sampled = parts[2]
+	}
+	return b3TraceContext(parts[0], parts[1], sampled, "")
+}
+
+// parseB3Multi parses the X-B3-TraceId, X-B3-SpanId, X-B3-Sampled and
+// X-B3-Flags headers of Zipkin's B3 propagation.
+func parseB3Multi(header http.Header) (traceContext, bool) {
+	return b3TraceContext(header.Get("X-B3-TraceId"), header.Get("X-B3-SpanId"),
+		header.Get("X-B3-Sampled"), header.Get("X-B3-Flags"))
+}
+
+// b3TraceContext validates B3 IDs, padding 64-bit trace IDs to 128 bits, and
+// turns the sampling state into W3C trace flags.
+func b3TraceContext(traceID, spanID, sampled, debug string) (traceContext, bool) {
+	traceID, spanID = strings.ToLower(traceID), strings.ToLower(spanID)
+	if len(traceID) == 16 {
+		traceID = strings.Repeat("0", 16) + traceID
+	}
+	if !isHexID(traceID, 32) || !isHexID(spanID, 16) {
+		return traceContext{}, false
+	}
+	flags := "00"
+	if sampled == "1" || sampled == "true" || sampled == "d" || debug == "1" {
+		flags = "01"
+	}
+	return traceContext{traceID: traceID, spanID: spanID, flags: flags}, true
+}
@@ -0,0 +1,143 @@
+package httplog
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OptionsFromEnv returns DefaultOptions overridden by the environment
+// variables below, named with the given prefix ("HTTPLOG" if empty):
+//
+//	<PREFIX>_LEVEL               LogLevel
+//	<PREFIX>_LEVEL_FIELD_NAME    LevelFieldName
+//	<PREFIX>_MESSAGE_FIELD_NAME  MessageFieldName
+//	<PREFIX>_JSON                JSON, a boolean as accepted by strconv.ParseBool
+//	<PREFIX>_CONCISE             Concise, a boolean
+//	<PREFIX>_SINGLE_LINE         SingleLine, a boolean
+//	<PREFIX>_START_LEVEL         StartLevel
+//	<PREFIX>_SERVICE_NAME        ServiceName
+//	<PREFIX>_SERVICE_VERSION     ServiceVersion
+//	<PREFIX>_HOST_INFO           IncludeHostInfo, a boolean
+//	<PREFIX>_TAGS                Tags, as comma separated key=value pairs
+//	<PREFIX>_SKIP_PATHS          SkipPaths, comma separated
+//	<PREFIX>_ONLY_PATHS          OnlyPaths, comma separated
+//	<PREFIX>_SKIP_METHODS        SkipMethods, comma separated
+//	<PREFIX>_SKIP_HEADERS        SkipHeaders, comma separated
+//	<PREFIX>_ONLY_HEADERS        OnlyHeaders, comma separated
+//	<PREFIX>_QUIET_DOWN_ROUTES   QuietDownRoutes, comma separated
+//	<PREFIX>_QUIET_DOWN_PERIOD   QuietDownPeriod, as accepted by time.ParseDuration
+//	<PREFIX>_TIME_FIELD_FORMAT   TimeFieldFormat
+//	<PREFIX>_TIME_FIELD_NAME     TimeFieldName
+//	<PREFIX>_NO_TIME             NoTime, a boolean
+//	<PREFIX>_SOURCE_FIELD_NAME   SourceFieldName
+//	<PREFIX>_DURATION_FIELD_NAME DurationFieldName
+//	<PREFIX>_DURATION_FIELD_UNIT DurationFieldUnit
+//
+// Unset variables leave the default in place. The resulting options are
+// checked with Options.Validate.
+func OptionsFromEnv(prefix string) (Options, error) {
+	if prefix == "" {
+		prefix = "HTTPLOG"
+	}
+	prefix = strings.TrimSuffix(prefix, "_") + "_"
+
+	opts := DefaultOptions
+
+	envString(prefix+"LEVEL", &opts.LogLevel)
+	envString(prefix+"START_LEVEL", &opts.StartLevel)
+	envString(prefix+"LEVEL_FIELD_NAME", &opts.LevelFieldName)
+	envString(prefix+"MESSAGE_FIELD_NAME", &opts.MessageFieldName)
+	envString(prefix+"TIME_FIELD_FORMAT", &opts.TimeFieldFormat)
+	envString(prefix+"TIME_FIELD_NAME", &opts.TimeFieldName)
+	envString(prefix+"SOURCE_FIELD_NAME", &opts.SourceFieldName)
+	envString(prefix+"DURATION_FIELD_NAME", &opts.DurationFieldName)
+	envString(prefix+"DURATION_FIELD_UNIT", &opts.DurationFieldUnit)
+	envString(prefix+"SERVICE_NAME", &opts.ServiceName)
+	envString(prefix+"SERVICE_VERSION", &opts.ServiceVersion)
+	envList(prefix+"SKIP_PATHS", &opts.SkipPaths)
+	envList(prefix+"ONLY_PATHS", &opts.OnlyPaths)
+	envList(prefix+"SKIP_METHODS", &opts.SkipMethods)
+	envList(prefix+"SKIP_HEADERS", &opts.SkipHeaders)
+	envList(prefix+"ONLY_HEADERS", &opts.OnlyHeaders)
+	envList(prefix+"QUIET_DOWN_ROUTES", &opts.QuietDownRoutes)
+
+	if err := envBool(prefix+"JSON", &opts.JSON); err != nil {
+		return Options{}, err
+	}
+	if err := envBool(prefix+"CONCISE", &opts.Concise); err != nil {
+		return Options{}, err
+	}
+	if err := envBool(prefix+"SINGLE_LINE", &opts.SingleLine); err != nil {
+		return Options{}, err
+	}
+	if err := envBool(prefix+"NO_TIME", &opts.NoTime); err != nil {
+		return Options{}, err
+	}
+	if err := envBool(prefix+"HOST_INFO", &opts.IncludeHostInfo); err != nil {
+		return Options{}, err
+	}
+
+	if v, ok := os.LookupEnv(prefix + "QUIET_DOWN_PERIOD"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return Options{}, fmt.Errorf("httplog: invalid %s: %w", prefix+"QUIET_DOWN_PERIOD", err)
+		}
+		opts.QuietDownPeriod = d
+	}
+
+	if v, ok := os.LookupEnv(prefix + "TAGS"); ok {
+		tags := map[string]string{}
+		for _, pair := range splitList(v) {
+			k, val, ok := strings.Cut(pair, "=")
+			if !ok || strings.TrimSpace(k) == "" {
+				return Options{}, fmt.Errorf("httplog: invalid %s: %q is not a key=value pair", prefix+"TAGS", pair)
+			}
+			tags[strings.TrimSpace(k)] = strings.TrimSpace(val)
+		}
+		opts.Tags = tags
+	}
+
+	if err := opts.Validate(); err != nil {
+		return Options{}, err
+	}
+	return opts, nil
+}
+
+func envString(key string, dst *string) {
+	if v, ok := os.LookupEnv(key); ok {
+		*dst = v
+	}
+}
+
+func envList(key string, dst *[]string) {
+	if v, ok := os.LookupEnv(key); ok {
+		*dst = splitList(v)
+	}
+}
+
+func envBool(key string, dst *bool) error {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("httplog: invalid %s: %w", key, err)
+	}
+	*dst = b
+	return nil
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,42 @@
+package httplog
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// errorChain returns the messages of err and all its causes, unwrapping
+// both errors.Unwrap and errors.Join chains depth-first, along with the type
+// of the innermost cause.
+func errorChain(err error) (causes []string, rootType string) {
+	var walk func(err error)
+	walk = func(err error) {
+		causes = append(causes, err.Error())
+		switch e := err.(type) {
+		case interface{ Unwrap() []error }:
+			for _, cause := range e.Unwrap() {
+				if cause != nil {
+					walk(cause)
+				}
+			}
+		default:
+			if cause := errors.Unwrap(err); cause != nil {
+				walk(cause)
+			} else if rootType == "" {
+				rootType = fmt.Sprintf("%T", err)
+			}
+		}
+	}
+	walk(err)
+	return causes, rootType
+}
+
+// errorChainAttrs returns the causes and root type of err as fields.
+func errorChainAttrs(err error, opts *Options) []slog.Attr {
+	causes, rootType := errorChain(err)
+	return []slog.Attr{
+		slog.Any(opts.fieldName("errorCauses"), causes),
+		slog.String(opts.fieldName("errorRootType"), rootType),
+	}
+}
@@ -0,0 +1,78 @@
+package httplog
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// floodState counts the records of a Logger per second for
+// Options.FloodLimit. It's kept on the Logger so it survives Configure.
+type floodState struct {
+	mu         sync.Mutex
+	window     time.Time
+	count      int
+	suppressed int
+}
+
+// allow counts a record and decides whether it's logged. Up to limit records
+// a second are, beyond that they are sampled with a rate falling as the
+// count rises. At the start of a new window it returns the number of records
+// suppressed in the last one.
+func (s *floodState) allow(limit int, now time.Time) (ok bool, suppressed, total int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.window) >= time.Second {
+		suppressed, total = s.suppressed, s.count
+		s.window, s.count, s.suppressed = now, 0, 0
+	}
+	s.count++
+	if s.count <= limit || rand.Float64() < float64(limit)/float64(s.count) {
+		return true, suppressed, total
+	}
+	s.suppressed++
+	return false, suppressed, total
+}
+
+// floodHandler applies Options.FloodLimit to the records of handler, warning
+// about suppressed records through root, the handler it was created with.
+type floodHandler struct {
+	state   *floodState
+	limit   int
+	root    slog.Handler
+	handler slog.Handler
+}
+
+var _ slog.Handler = &floodHandler{}
+
+func (h *floodHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *floodHandler) Handle(ctx context.Context, r slog.Record) error {
+	if ctx.Value(mustLogCtxKey) != nil {
+		return h.handler.Handle(ctx, r)
+	}
+	ok, suppressed, total := h.state.allow(h.limit, time.Now())
+	if suppressed > 0 {
+		warning := slog.NewRecord(time.Now(), slog.LevelWarn,
+			fmt.Sprintf("httplog: suppressed %d of %d logs in the last second, above the limit of %d/s", suppressed, total, h.limit), 0)
+		_ = h.root.Handle(ctx, warning)
+	}
+	if !ok {
+		return nil
+	}
+	return h.handler.Handle(ctx, r)
+}
+
+func (h *floodHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &floodHandler{state: h.state, limit: h.limit, root: h.root, handler: h.handler.WithAttrs(attrs)}
+}
+
+func (h *floodHandler) WithGroup(name string) slog.Handler {
+	return &floodHandler{state: h.state, limit: h.limit, root: h.root, handler: h.handler.WithGroup(name)}
+}
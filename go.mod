@@ -1,8 +1,10 @@
-module github.com/piscopoc/httplog
+module github.com/piscopoc/httplog/v2
 
-go 1.20
+go 1.21
 
 require (
 	github.com/go-chi/chi/v5 v5.0.7
-	golang.org/x/exp v0.0.0-20230108222341-4b8118a2686a
+	go.opentelemetry.io/otel v1.29.0
+	go.opentelemetry.io/otel/trace v1.29.0
+	gopkg.in/yaml.v3 v3.0.1
 )
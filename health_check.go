@@ -0,0 +1,42 @@
+package httplog
+
+import (
+	"net/http"
+	"strings"
+)
+
+// healthCheckPaths are the paths commonly used for liveness and readiness
+// probes.
+var healthCheckPaths = map[string]bool{
+	"/health":      true,
+	"/healthz":     true,
+	"/healthcheck": true,
+	"/livez":       true,
+	"/readyz":      true,
+	"/ready":       true,
+	"/ping":        true,
+}
+
+// healthCheckUserAgents are User-Agent prefixes of common probes.
+var healthCheckUserAgents = []string{
+	"kube-probe/",
+	"ELB-HealthChecker/",
+	"GoogleHC/",
+	"Consul Health Check",
+	"Envoy/HC",
+}
+
+// healthCheck reports whether r looks like a health check, see
+// Options.LogHealthChecks.
+func healthCheck(r *http.Request) bool {
+	if healthCheckPaths[strings.TrimSuffix(r.URL.Path, "/")] {
+		return true
+	}
+	ua := r.UserAgent()
+	for _, prefix := range healthCheckUserAgents {
+		if strings.HasPrefix(ua, prefix) {
+			return true
+		}
+	}
+	return false
+}
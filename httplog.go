@@ -2,246 +2,792 @@ package httplog
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"io"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"golang.org/x/exp/slog"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func NewLogger(serviceName string, opts ...Options) *slog.Logger {
-	if len(opts) > 0 {
-		Configure(opts[0])
-	} else {
-		Configure(DefaultOptions)
-	}
-	logger := slog.With(slog.Attr{Key: "service", Value: slog.StringValue(strings.ToLower(serviceName))})
-	// logger := log.With().Str("service", strings.ToLower(serviceName))
-	if !DefaultOptions.Concise && len(DefaultOptions.Tags) > 0 {
-		group := []slog.Attr{}
-		for k, v := range DefaultOptions.Tags {
-			group = append(group, slog.Attr{Key: k, Value: slog.StringValue(v)})
-		}
-		logger = logger.With(slog.Group("tags", group...))
+// Logger is an http request logger with its own Options and slog instance.
+// Unlike the package-level Configure, a Logger never touches slog's global
+// default, so several services in one process can each log with their own
+// settings.
+type Logger struct {
+	*slog.Logger
+
+	serviceName string
+	opts        atomic.Pointer[Options]
+	level       slog.LevelVar
+	handler     *swapHandler
+	init        sync.Once
+
+	quiet        QuietDownStore
+	routeLimiter routeLimiter
+	flood        floodState
+}
+
+// NewLogger returns an isolated Logger for serviceName. Its configuration
+// starts out as DefaultOptions and the given opts are applied in order.
+func NewLogger(serviceName string, opts ...Option) *Logger {
+	options := DefaultOptions
+	for _, opt := range opts {
+		opt.apply(&options)
 	}
+	logger := &Logger{serviceName: strings.ToLower(serviceName)}
+	logger.Configure(options)
 	return logger
 }
 
+// Options returns the options currently in effect for the logger, with
+// defaults filled in.
+func (l *Logger) Options() Options {
+	return *l.opts.Load()
+}
+
+// Handler returns the http middleware for the logger, see Handler.
+//
+// NOTE: this shadows the embedded (*slog.Logger).Handler method, use
+// l.Logger.Handler() to get at the underlying slog.Handler.
+func (l *Logger) Handler() func(next http.Handler) http.Handler {
+	return Handler(l)
+}
+
 // RequestLogger is an http middleware to log http requests and responses.
 //
-// NOTE: for simplicity, RequestLogger automatically makes use of the chi RequestID and
-// Recoverer middleware.
-func RequestLogger(logger *slog.Logger) func(next http.Handler) http.Handler {
-	return chi.Chain(
-		middleware.RequestID,
-		Handler(logger),
-		middleware.Recoverer,
-	).Handler
-}
-
-func Handler(logger *slog.Logger) func(next http.Handler) http.Handler {
-	var f middleware.LogFormatter = &requestLogger{*logger}
+// NOTE: for simplicity, RequestLogger automatically makes use of the RequestID
+// and Recoverer middleware.
+func RequestLogger(logger *Logger) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
-		fn := func(w http.ResponseWriter, r *http.Request) {
-			if rInCooldown(r) {
-				next.ServeHTTP(w, r)
-				return
-			}
-			entry := f.NewLogEntry(r)
-			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
-
-			buf := newLimitBuffer(512)
-			ww.Tee(buf)
+		// attribute the logs to next rather than Recoverer
+		return RequestID(logger)(handler(logger, Recoverer(next), handlerPC(next)))
+	}
+}
 
-			t1 := time.Now()
-			defer func() {
-				var respBody []byte
-				if ww.Status() >= 400 {
-					respBody, _ = io.ReadAll(buf)
-				}
-				entry.Write(ww.Status(), ww.BytesWritten(), ww.Header(), time.Since(t1), respBody)
-			}()
+// Handler is an http middleware logging requests and responses with logger.
+// Unlike RequestLogger, it does not install any other middleware.
+//
+// Requests exceeding the deadline of their context are logged with the
+// "timeout" and "deadline" fields. Timeout middleware such as
+// http.TimeoutHandler or chi's middleware.Timeout has to be applied before
+// Handler for it to see the deadline, eg.
+//
+//	r.Use(middleware.Timeout(10 * time.Second))
+//	r.Use(httplog.Handler(logger))
+//
+// Applied after Handler, they derive a context of their own and their
+// responses are logged like any other 503 or 504.
+func Handler(logger *Logger) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return handler(logger, next, handlerPC(next))
+	}
+}
 
-			next.ServeHTTP(ww, middleware.WithLogEntry(r, entry))
+// handler is the middleware of Handler for next, attributing its logs to pc.
+func handler(logger *Logger, next http.Handler, pc uintptr) http.Handler {
+	f := &requestLogger{logger}
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		opts := logger.opts.Load()
+		countConnRequest(r)
+		if opts.skipPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		hold := holdNone
+		if opts.skipMethod(r.Method) {
+			hold = holdSuccess
+		}
+		quietRules := logger.quietRules(r, opts)
+		if len(quietRules) > 0 && hold == holdNone {
+			hold = holdQuiet
+		}
+		entry := f.newLogEntry(r, opts, hold, pc)
+		entry.quietRules = quietRules
+		w, ww := newResponseWriter(w, r.ProtoMajor)
+
+		capture := &logCapture{requestTrailer: r.Trailer}
+		if opts.LogRequestBody && r.Body != nil && r.Body != http.NoBody {
+			capture.requestBody = newLimitBuffer(opts.BodyMaxBytes)
+			capture.requestContentType = r.Header.Get("Content-Type")
+			r.Body = &teeReadCloser{ReadCloser: r.Body, w: capture.requestBody}
+		}
+		if opts.LogBandwidth && r.Body != nil && r.Body != http.NoBody {
+			capture.requestBytes = &countReadCloser{ReadCloser: r.Body}
+			r.Body = capture.requestBytes
 		}
-		return http.HandlerFunc(fn)
+		if opts.LogResponseBody || opts.ResponseBodyMinStatus > 0 || !opts.Concise {
+			capture.responseBody = newLimitBuffer(opts.BodyMaxBytes)
+			// only bodies which are logged, to keep eg. sendfile otherwise
+			ww.Tee(capture.responseBody, opts.responseBodyMinStatus())
+		}
+
+		// keep the request passed on, http.ServeMux sets its Pattern
+		r = middleware.WithLogEntry(r, entry)
+
+		t1 := time.Now()
+		deadline, hasDeadline := r.Context().Deadline()
+		returned := false
+		defer func() {
+			switch err := r.Context().Err(); {
+			case hasDeadline && errors.Is(err, context.DeadlineExceeded):
+				capture.timeout = deadline.Sub(t1)
+			case errors.Is(err, context.Canceled):
+				// the server cancels the context when the client goes away
+				capture.clientDisconnected = true
+			}
+			capture.request = r
+			capture.hijacked = ww.Hijacked()
+			capture.pushed = ww.Pushed()
+			capture.writeErr = ww.WriteError()
+			capture.interim = ww.Interim()
+			if at := ww.WroteAt(); !at.IsZero() {
+				capture.ttfb = at.Sub(t1)
+			}
+			capture.path = r.URL.Path
+			capture.route = routePattern(r)
+			if capture.route == "" {
+				capture.route = opts.normalizePath(r.URL.Path)
+			}
+			status := ww.Status()
+			if errors.Is(capture.writeErr, http.ErrHandlerTimeout) {
+				// http.TimeoutHandler sent its 503 instead of the response
+				status = http.StatusServiceUnavailable
+			}
+			if status == 0 && returned && !capture.hijacked && capture.timeout == 0 {
+				// the handler wrote nothing, net/http sends an empty 200
+				status, capture.noWrite = http.StatusOK, true
+			}
+			capture.implicitStatus = status != 0 && !ww.ExplicitStatus()
+			entry.Write(status, ww.BytesWritten(), ww.Header(), time.Since(t1), capture)
+		}()
+
+		next.ServeHTTP(w, r)
+		returned = true
 	}
+	return http.HandlerFunc(fn)
 }
 
 type requestLogger struct {
-	Logger slog.Logger
+	Logger *Logger
 }
 
 func (l *requestLogger) NewLogEntry(r *http.Request) middleware.LogEntry {
-	entry := &RequestLoggerEntry{}
+	countConnRequest(r)
+	return l.newLogEntry(r, l.Logger.opts.Load(), holdNone, 0)
+}
+
+// holdBack is why the logs of a request are held back until it's done,
+// deciding whether to write them.
+type holdBack int
+
+const (
+	holdNone    holdBack = iota
+	holdSuccess          // logged only if the request fails, with SkipMethods
+	holdQuiet            // logged unless quieted, with QuietDownRoutes
+)
+
+// newLogEntry creates the log entry of the request. The logs of held back
+// requests are buffered until Write decides whether to write them. The
+// request and response logs are attributed to pc, if not zero.
+func (l *requestLogger) newLogEntry(r *http.Request, opts *Options, hold holdBack, pc uintptr) *RequestLoggerEntry {
+	entry := &RequestLoggerEntry{opts: opts, logger: l.Logger, hold: hold, pc: pc}
 	msg := fmt.Sprintf("Request: %s %s", r.Method, r.URL.Path)
-	entry.Logger = *l.Logger.With(requestLogFields(r, true))
-	if !DefaultOptions.Concise {
-		entry.Logger = *l.Logger.With(requestLogFields(r, DefaultOptions.Concise))
-		entry.Logger.Info(msg)
+	entry.Logger = l.Logger.With(requestLogFields(r, opts.Concise, opts))
+	if fields := correlationLogFields(r, opts); len(fields) > 0 {
+		entry.Logger = slog.New(entry.Logger.Handler().WithAttrs(fields))
+	}
+	if span := trace.SpanFromContext(r.Context()); opts.OTelSpan != "" && span.IsRecording() {
+		entry.span = span
+	}
+	if level, ok := opts.routeLevel(r.URL.Path); ok {
+		entry.Logger = slog.New(&minLevelHandler{level: level, handler: entry.Logger.Handler()})
+	}
+	// buffer below the stack trace, which is of the code logging
+	if opts.TailBuffering || hold != holdNone {
+		entry.tail = &tailBuffer{
+			keep: opts.TailDebugHeader != "" && r.Header.Get(opts.TailDebugHeader) != "",
+			all:  opts.TailBuffering,
+		}
+		entry.Logger = slog.New(&tailHandler{buf: entry.tail, handler: entry.Logger.Handler()})
+	}
+	if opts.StackTraceOnError {
+		entry.Logger = slog.New(&stackTraceHandler{key: opts.fieldName("stacktrace"), handler: entry.Logger.Handler()})
+	}
+	if opts.DynamicTags != nil {
+		if tags := opts.DynamicTags(r); len(tags) > 0 {
+			entry.Logger = slog.New(entry.Logger.Handler().WithAttrs(tags))
+		}
+	}
+	if opts.SampleRate > 0 && opts.SampleRate < 1 {
+		sampled := sampleRequest(r, opts.SampleRate)
+		entry.sampled = &sampled
+	}
+	entry.downgrade = opts.staticAsset(r.URL.Path) || !opts.LogHealthChecks && healthCheck(r)
+	if !opts.Concise && !opts.SingleLine && (entry.sampled == nil || *entry.sampled) {
+		startLevel := opts.parseLogLevel(opts.StartLevel)
+		if entry.downgrade {
+			startLevel = slog.LevelDebug
+		}
+		logAttrs(r.Context(), entry.Logger, opts, pc, startLevel, msg)
 	}
 	return entry
 }
 
+// logCapture carries what the middleware captured of the request and
+// response to RequestLoggerEntry.Write. The bodies are nil if not captured.
+type logCapture struct {
+	requestBody        *limitBuffer
+	requestContentType string
+	requestTrailer     http.Header
+	responseBody       *limitBuffer
+	request            *http.Request
+	route              string
+	path               string
+	timeout            time.Duration // the request deadline, if exceeded
+	clientDisconnected bool
+	hijacked           bool
+	pushed             int // resources pushed with HTTP/2 server push
+	requestBytes       *countReadCloser
+	implicitStatus     bool // the handler didn't call WriteHeader
+	noWrite            bool // the handler wrote neither a status nor a body
+	writeErr           error
+	interim            []int         // informational statuses
+	ttfb               time.Duration // until the first status was sent, if any
+}
+
 type RequestLoggerEntry struct {
-	Logger slog.Logger
+	Logger *slog.Logger
 	msg    string
+	opts   *Options
+	span   trace.Span
+	logger *Logger // nil if created outside of a Logger
+	pc     uintptr // the source of the request and response logs
+
+	mu    sync.Mutex
+	attrs []slog.Attr // added for the response log
+	err   error
+	tail  *tailBuffer // with Options.TailBuffering
+	// the body bytes counted by CountUncompressed
+	uncompressed int
+
+	sampled    *bool // with Options.SampleRate
+	hold       holdBack
+	quietRules []quietRule
+	downgrade  bool // successful requests are logged at debug level
+	panicked   bool
+}
+
+// Add adds attrs to the response log of the request only, unlike fields set
+// on the Logger, which appear on every line logged afterwards. It's safe for
+// concurrent use, and a no-op on a nil entry, eg. as returned by Entry
+// outside of a request.
+func (l *RequestLoggerEntry) Add(attrs ...slog.Attr) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.attrs = append(l.attrs, attrs...)
+}
+
+// SetError records err as the error of the request, raising its response log
+// to error level and including the error message and type, so handlers can
+// report failures without logging a line of their own. A later call replaces
+// the error, nil clears it. It's a no-op on a nil entry.
+func (l *RequestLoggerEntry) SetError(err error) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.err = err
+}
+
+// KeepLogs makes the logs of the request be written with
+// Options.TailBuffering even if it succeeds, eg. when a handler notices
+// something worth debugging. It's a no-op on a nil entry.
+func (l *RequestLoggerEntry) KeepLogs() {
+	if l != nil && l.tail != nil {
+		l.tail.mu.Lock()
+		defer l.tail.mu.Unlock()
+		l.tail.keep = true
+	}
 }
 
 func (l *RequestLoggerEntry) Write(status, bytes int, header http.Header, elapsed time.Duration, extra interface{}) {
+	capture, _ := extra.(*logCapture)
+	if capture == nil {
+		capture = &logCapture{}
+	}
+	if l.opts.Skip != nil && capture.request != nil && l.opts.Skip(capture.request, status, elapsed) {
+		if l.tail != nil {
+			l.tail.release(false)
+		}
+		if l.span != nil {
+			recordSpan(l.span, l.opts.OTelSpan, status, bytes, elapsed)
+		}
+		return
+	}
+
 	msg := fmt.Sprintf("Response: %d %s", status, statusLabel(status))
+	responseLog := []slog.Attr{
+		{Key: l.opts.fieldName("status"), Value: slog.IntValue(status)},
+		{Key: l.opts.fieldName("bytes"), Value: slog.IntValue(bytes)},
+		{Key: l.opts.fieldName(l.opts.DurationFieldName), Value: durationValue(elapsed, l.opts.DurationFieldUnit)},
+	}
+	if capture.ttfb > 0 {
+		responseLog = append(responseLog, slog.Attr{Key: l.opts.fieldName("ttfb"), Value: durationValue(capture.ttfb, l.opts.DurationFieldUnit)})
+	}
+	level := l.opts.statusLevel(status)
+	if capture.hijacked {
+		// the handler took over the connection, eg. for a WebSocket, so the
+		// status and bytes written through the writer don't tell anything
+		msg = "Response: hijacked"
+		responseLog = []slog.Attr{
+			slog.Bool(l.opts.fieldName("hijacked"), true),
+			{Key: l.opts.fieldName(l.opts.DurationFieldName), Value: durationValue(elapsed, l.opts.DurationFieldUnit)},
+		}
+		level = slog.LevelInfo
+	}
 	if l.msg != "" {
 		msg = fmt.Sprintf("%s - %s", msg, l.msg)
 	}
 
-	responseLog := []slog.Attr{
-		{Key: "status", Value: slog.IntValue(status)},
-		{Key: "bytes", Value: slog.IntValue(bytes)},
-		{Key: "elapsed", Value: slog.Float64Value(float64(elapsed.Nanoseconds()) / 1000000.0)}, // in milliseconds
+	if l.downgrade && level < slog.LevelWarn {
+		level = slog.LevelDebug
+	}
+	if l.panicked {
+		// eg. after part of the body was sent with a successful status
+		level = max(level, slog.LevelError)
+	}
+	if l.opts.SlowRequestThreshold > 0 || l.opts.SlowRequestErrorThreshold > 0 {
+		slow := false
+		if t := l.opts.SlowRequestThreshold; t > 0 && elapsed > t {
+			slow, level = true, max(level, slog.LevelWarn)
+		}
+		if t := l.opts.SlowRequestErrorThreshold; t > 0 && elapsed > t {
+			slow, level = true, max(level, slog.LevelError)
+		}
+		responseLog = append(responseLog, slog.Bool(l.opts.fieldName("slow"), slow))
 	}
 
-	if !DefaultOptions.Concise {
-		// Include response header, as well for error status codes (>400) we include
-		// the response body so we may inspect the log message sent back to the client.
-		if status >= 400 {
-			body, _ := extra.([]byte)
-			responseLog = append(responseLog, slog.Attr{Key: "body", Value: slog.StringValue(string(body))})
+	if capture.clientDisconnected {
+		// bytes has what was written before the client went away
+		msg = fmt.Sprintf("%s (client disconnected)", msg)
+		responseLog = append(responseLog, slog.Bool(l.opts.fieldName("client_disconnected"), true))
+	}
+
+	if l.opts.LogBandwidth && !capture.hijacked {
+		var bytesIn int64
+		if capture.requestBytes != nil {
+			bytesIn = capture.requestBytes.n
 		}
-		if len(header) > 0 {
-			responseLog = append(responseLog, slog.Group("header", headerLogField(header)...))
+		responseLog = append(responseLog,
+			slog.Int64(l.opts.fieldName("bytes_in"), bytesIn),
+			slog.Int(l.opts.fieldName("bytes_out"), bytes))
+	}
+
+	if capture.noWrite {
+		responseLog = append(responseLog, slog.Bool(l.opts.fieldName("no_write"), true))
+	} else if capture.implicitStatus && !l.opts.Concise {
+		responseLog = append(responseLog, slog.Bool(l.opts.fieldName("implicit_status"), true))
+	}
+
+	if capture.writeErr != nil {
+		responseLog = append(responseLog, slog.String(l.opts.fieldName("write_error"), capture.writeErr.Error()))
+	}
+
+	if len(capture.interim) > 0 {
+		responseLog = append(responseLog, slog.Any(l.opts.fieldName("informational"), capture.interim))
+	}
+
+	if encoding := header.Get("Content-Encoding"); encoding != "" && !capture.hijacked {
+		responseLog = append(responseLog, slog.String(l.opts.fieldName("encoding"), encoding))
+		l.mu.Lock()
+		uncompressed := l.uncompressed
+		l.mu.Unlock()
+		if uncompressed > 0 {
+			// bytes is what the compression middleware below wrote
+			responseLog = append(responseLog,
+				slog.Int(l.opts.fieldName("uncompressed_bytes"), uncompressed),
+				slog.Float64(l.opts.fieldName("compression_ratio"), math.Round(float64(bytes)/float64(uncompressed)*1000)/1000))
 		}
 	}
-	l.Logger.With(slog.Group("httpResponse", responseLog...)).Log(statusLevel(status), msg)
-}
 
-func (l *RequestLoggerEntry) Panic(v interface{}, stack []byte) {
-	stacktrace := "#"
-	if DefaultOptions.JSON {
-		stacktrace = string(stack)
+	if status == http.StatusPartialContent {
+		// for debugging byte-range requests, eg. of CDNs
+		if capture.request != nil {
+			responseLog = append(responseLog, slog.String(l.opts.fieldName("range"), capture.request.Header.Get("Range")))
+		}
+		responseLog = append(responseLog, slog.String(l.opts.fieldName("content_range"), header.Get("Content-Range")))
+		if n, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+			responseLog = append(responseLog, slog.Int64(l.opts.fieldName("content_length"), n))
+		}
 	}
-	l.Logger = *l.Logger.With(slog.Attr{Key: "stacktrace", Value: slog.StringValue(stacktrace)},
-		slog.Attr{Key: "panic", Value: slog.StringValue(fmt.Sprintf("%+v", v))})
-	// l.Logger = l.Logger.With().
-	// 	Str("stacktrace", stacktrace).
-	// 	Str("panic", fmt.Sprintf("%+v", v)).
-	// 	Logger()
 
-	l.msg = fmt.Sprintf("%+v", v)
+	if capture.pushed > 0 {
+		responseLog = append(responseLog, slog.Int(l.opts.fieldName("pushed"), capture.pushed))
+	}
 
-	if !DefaultOptions.JSON {
-		middleware.PrintPrettyStack(v)
+	if capture.timeout > 0 {
+		responseLog = append(responseLog,
+			slog.Bool(l.opts.fieldName("timeout"), true),
+			slog.Attr{Key: l.opts.fieldName("deadline"), Value: durationValue(capture.timeout, l.opts.DurationFieldUnit)})
+	}
+
+	// Include the response body if asked to, as well for error status codes (>400)
+	// we include it so we may inspect the log message sent back to the client.
+	if capture.responseBody != nil && status >= l.opts.responseBodyMinStatus() {
+		responseLog = append(responseLog, bodyLogFields(capture.responseBody, header.Get("Content-Type"), "body", l.opts)...)
+	}
+
+	// Include response header, selected LogResponseHeaders are included in
+	// Concise mode as well
+	if len(header) > 0 && (!l.opts.Concise || l.opts.LogResponseHeaders != nil) {
+		headerKey := "header"
+		if l.opts.flatFields() {
+			// don't clash with the request header
+			headerKey = "responseHeader"
+		}
+		only := l.opts.OnlyHeaders
+		if l.opts.LogResponseHeaders != nil {
+			only = l.opts.LogResponseHeaders
+		}
+		responseLog = append(responseLog, slog.Attr{Key: l.opts.fieldName(headerKey), Value: slog.GroupValue(headerLogField(header, only, l.opts)...)})
+	}
+	if trailer := responseTrailer(header); len(trailer) > 0 && !l.opts.Concise {
+		responseLog = append(responseLog, slog.Attr{Key: l.opts.fieldName("trailers"), Value: slog.GroupValue(headerLogField(trailer, l.opts.OnlyHeaders, l.opts)...)})
+	}
+	attrs := []slog.Attr{{Key: l.opts.groupName("httpResponse"), Value: slog.GroupValue(responseLog...)}}
+	if capture.route != "" {
+		attrs = append(attrs, slog.String(l.opts.fieldName("route"), capture.route))
+	}
+	if l.sampled != nil {
+		attrs = append(attrs, slog.Bool(l.opts.fieldName("sampled"), *l.sampled))
+	}
+	l.mu.Lock()
+	attrs = append(attrs, l.attrs...)
+	if l.err != nil {
+		level = max(level, slog.LevelError)
+		attrs = append(attrs,
+			slog.String(l.opts.fieldName("error"), l.err.Error()),
+			slog.String(l.opts.fieldName("errorType"), fmt.Sprintf("%T", l.err)))
+		if l.opts.ErrorChains {
+			attrs = append(attrs, errorChainAttrs(l.err, l.opts)...)
+		}
+	}
+	l.mu.Unlock()
+	// Server errors and panics are never hidden by the noise controls,
+	// unless asked to, nor counted as suppressed by them
+	mustLog := !l.opts.SuppressErrors && (status >= 500 || l.panicked)
+	quiet := false
+	anomaly := status >= 400 || level >= slog.LevelWarn
+	if len(l.quietRules) > 0 && l.logger != nil && !mustLog && !(l.opts.QuietDownOnlySuccess && anomaly) {
+		var suppressed int
+		quiet, suppressed = l.logger.quietDown(l.quietRules, status, elapsed, l.opts)
+		if suppressed > 0 {
+			attrs = append(attrs, slog.Int(l.opts.fieldName("suppressed"), suppressed))
+		}
+	}
+	if capture.requestBody != nil {
+		attrs = append(attrs, bodyLogFields(capture.requestBody, capture.requestContentType, "requestBody", l.opts)...)
+	}
+	if trailer := nonEmptyHeader(capture.requestTrailer); len(trailer) > 0 && !l.opts.Concise {
+		attrs = append(attrs, slog.Attr{Key: l.opts.fieldName("requestTrailers"), Value: slog.GroupValue(headerLogField(trailer, l.opts.OnlyHeaders, l.opts)...)})
 	}
-}
 
-var coolDownMu sync.RWMutex
-var coolDowns = map[string]time.Time{}
+	if l.tail != nil {
+		flush := mustLog
+		switch {
+		case quiet:
+		case l.opts.TailBuffering:
+			slow := l.opts.TailLatency > 0 && elapsed > l.opts.TailLatency
+			flush = flush || slow || level >= slog.LevelError
+		case l.hold == holdSuccess:
+			flush = flush || level >= slog.LevelWarn
+		default:
+			flush = true
+		}
+		l.tail.release(flush)
+	}
+	route := capture.route
+	if route == "" {
+		route = capture.path
+	}
+	if mustLog {
+		ctx := context.WithValue(context.Background(), mustLogCtxKey, true)
+		logAttrs(ctx, l.Logger, l.opts, l.pc, level, msg, attrs...)
+	} else if !quiet && l.keepResponseLog(route, level) {
+		logAttrs(context.Background(), l.Logger, l.opts, l.pc, level, msg, attrs...)
+	}
 
-func rInCooldown(r *http.Request) bool {
-	routePath := r.URL.EscapedPath()
-	if routePath == "" {
-		routePath = "/"
+	if l.span != nil {
+		recordSpan(l.span, l.opts.OTelSpan, status, bytes, elapsed)
 	}
-	if !inArray(DefaultOptions.QuietDownRoutes, routePath) {
-		return false
+}
+
+// responseTrailer returns the trailers set on the response header, declared
+// in the Trailer header or set with the http.TrailerPrefix.
+func responseTrailer(header http.Header) http.Header {
+	trailer := http.Header{}
+	for _, declared := range header.Values("Trailer") {
+		for _, k := range strings.Split(declared, ",") {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			if values := header.Values(k); k != "" && len(values) > 0 {
+				trailer[k] = values
+			}
+		}
+	}
+	for k, values := range header {
+		if name, ok := strings.CutPrefix(k, http.TrailerPrefix); ok && len(values) > 0 {
+			trailer[http.CanonicalHeaderKey(name)] = values
+		}
 	}
-	coolDownMu.RLock()
-	coolDownTime, ok := coolDowns[routePath]
-	coolDownMu.RUnlock()
-	if ok {
-		if time.Since(coolDownTime) < DefaultOptions.QuietDownPeriod {
-			return true
+	return trailer
+}
+
+// nonEmptyHeader returns the header without keys that have no values, eg.
+// declared request trailers which weren't sent.
+func nonEmptyHeader(header http.Header) http.Header {
+	nonEmpty := http.Header{}
+	for k, values := range header {
+		if len(values) > 0 {
+			nonEmpty[k] = values
 		}
 	}
-	coolDownMu.Lock()
-	defer coolDownMu.Unlock()
-	coolDowns[routePath] = time.Now().Add(DefaultOptions.QuietDownPeriod)
-	return false
+	return nonEmpty
 }
 
-func inArray(arr []string, val string) bool {
-	for _, v := range arr {
-		if v == val {
-			return true
+// bodyLogFields returns the captured body as the field named key, along with
+// a "<key>Truncated" field if it didn't fit into BodyMaxBytes. Bodies of a
+// content type not in BodyContentTypes are only logged with their content
+// type and size.
+func bodyLogFields(body *limitBuffer, contentType, key string, opts *Options) []slog.Attr {
+	if contentType == "" {
+		contentType = http.DetectContentType(body.Bytes())
+	}
+	if !opts.logsBody(contentType) {
+		return []slog.Attr{
+			slog.String(opts.fieldName(key+"ContentType"), contentType),
+			slog.Int(opts.fieldName(key+"Size"), body.size),
 		}
 	}
-	return false
+
+	value := body.String()
+	if len(opts.RedactJSONPaths) > 0 && isJSON(contentType) {
+		redactedBody, err := redactJSON(body.Bytes(), opts.RedactJSONPaths)
+		if err != nil {
+			// eg. a truncated body, which can't be redacted reliably
+			value = redacted
+		} else {
+			value = string(redactedBody)
+		}
+	}
+
+	fields := []slog.Attr{{Key: opts.fieldName(key), Value: slog.StringValue(opts.mask(value))}}
+	if body.truncated {
+		fields = append(fields, slog.Bool(opts.fieldName(key+"Truncated"), true))
+	}
+	return fields
 }
 
-func requestLogFields(r *http.Request, concise bool) slog.Attr {
+// keepResponseLog applies the noise controls to the response log of route.
+func (l *RequestLoggerEntry) keepResponseLog(route string, level slog.Level) bool {
+	if l.hold == holdSuccess && level < slog.LevelWarn {
+		return false
+	}
+	if l.sampled != nil && !*l.sampled && level < slog.LevelWarn {
+		return false
+	}
+	return l.allowRoute(route, level)
+}
+
+// allowRoute applies Options.RouteRateLimit to the response log of route,
+// logging how many lines were suppressed before it if any.
+func (l *RequestLoggerEntry) allowRoute(route string, level slog.Level) bool {
+	if l.opts.RouteRateLimit <= 0 || l.logger == nil || level >= slog.LevelWarn {
+		return true
+	}
+	ok, suppressed := l.logger.routeLimiter.allow(route, l.opts.RouteRateLimit, time.Now())
+	if suppressed > 0 {
+		logAttrs(context.Background(), l.logger.Logger, l.opts, 0, slog.LevelWarn,
+			fmt.Sprintf("Suppressed %d response logs of %s", suppressed, route),
+			slog.String(l.opts.fieldName("route"), route),
+			slog.Int(l.opts.fieldName("suppressed"), suppressed))
+	}
+	return ok
+}
+
+func (l *RequestLoggerEntry) Panic(v interface{}, stack []byte) {
+	stacktrace := slog.StringValue("#")
+	if l.opts.JSON {
+		stacktrace = slog.AnyValue(parseStack(stack))
+	}
+	l.Logger = l.Logger.With(slog.Attr{Key: l.opts.fieldName("stacktrace"), Value: stacktrace},
+		slog.Attr{Key: l.opts.fieldName("panic"), Value: slog.StringValue(fmt.Sprintf("%+v", v))})
+	// l.Logger = l.Logger.With().
+	// 	Str("stacktrace", stacktrace).
+	// 	Str("panic", fmt.Sprintf("%+v", v)).
+	// 	Logger()
+
+	l.msg = fmt.Sprintf("%+v", v)
+	l.panicked = true
+
+	if !l.opts.JSON {
+		middleware.PrintPrettyStack(v)
+	}
+}
+
+func requestLogFields(r *http.Request, concise bool, opts *Options) slog.Attr {
 	scheme := "http"
 	if r.TLS != nil {
 		scheme = "https"
 	}
-	requestURL := fmt.Sprintf("%s://%s%s", scheme, r.Host, r.RequestURI)
+	requestURI := redactQuery(r.RequestURI, opts.RedactQueryParams)
+	requestURL := opts.mask(fmt.Sprintf("%s://%s%s", scheme, r.Host, requestURI))
 
 	requestFields := []slog.Attr{
-		{Key: "requestURL", Value: slog.StringValue(requestURL)},
-		{Key: "requestMethod", Value: slog.StringValue(r.Method)},
-		{Key: "requestPath", Value: slog.StringValue(r.URL.Path)},
-		{Key: "remoteIP", Value: slog.StringValue(r.RemoteAddr)},
-		{Key: "proto", Value: slog.StringValue(r.Proto)},
-	}
-	if reqID := middleware.GetReqID(r.Context()); reqID != "" {
-		requestFields = append(requestFields, slog.Attr{Key: "requestID", Value: slog.StringValue(reqID)})
+		{Key: opts.fieldName("requestURL"), Value: slog.StringValue(requestURL)},
+		{Key: opts.fieldName("requestMethod"), Value: slog.StringValue(r.Method)},
+		{Key: opts.fieldName("requestPath"), Value: slog.StringValue(opts.mask(r.URL.Path))},
+		{Key: opts.fieldName("remoteIP"), Value: slog.StringValue(r.RemoteAddr)},
+		{Key: opts.fieldName("proto"), Value: slog.StringValue(r.Proto)},
+	}
+	if n := connRequests(r); n > 0 {
+		requestFields = append(requestFields,
+			slog.Int64(opts.fieldName("connRequests"), n),
+			slog.Bool(opts.fieldName("connReused"), n > 1))
+	}
+	if len(opts.TrustedProxies) > 0 {
+		requestFields = append(requestFields, slog.String(opts.fieldName("clientIP"), clientIP(r, opts.trustedProxies)))
+	}
+	if opts.SemConv {
+		// network.peer.address is the bare IP, with the port on its own
+		if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			requestFields[3].Value = slog.StringValue(host)
+			if p, err := strconv.Atoi(port); err == nil {
+				requestFields = append(requestFields, slog.Int(opts.fieldName("remotePort"), p))
+			}
+		}
+	}
+	if reqID := GetRequestID(r.Context()); reqID != "" {
+		requestFields = append(requestFields, slog.Attr{Key: opts.fieldName("requestID"), Value: slog.StringValue(reqID)})
 		// requestFields["requestID"] = reqID
 	}
 
 	if concise {
-		return slog.Group("httpRequest", requestFields...)
+		return slog.Attr{Key: opts.groupName("httpRequest"), Value: slog.GroupValue(requestFields...)}
 	}
 
 	// requestFields["scheme"] = scheme
-	requestFields = append(requestFields, slog.Attr{Key: "scheme", Value: slog.StringValue(scheme)})
+	requestFields = append(requestFields, slog.Attr{Key: opts.fieldName("scheme"), Value: slog.StringValue(scheme)})
+	if r.TLS != nil {
+		requestFields = append(requestFields, slog.Attr{Key: opts.groupName("tls"), Value: slog.GroupValue(
+			slog.String(opts.fieldName("tlsVersion"), tls.VersionName(r.TLS.Version)),
+			slog.String(opts.fieldName("cipherSuite"), tls.CipherSuiteName(r.TLS.CipherSuite)),
+			slog.String(opts.fieldName("serverName"), r.TLS.ServerName),
+			slog.String(opts.fieldName("alpn"), r.TLS.NegotiatedProtocol),
+		)})
+	}
 	if len(r.Header) > 0 {
 		// requestFields["header"] = headerLogField(r.Header)
 		requestFields = append(requestFields,
-			slog.Attr{Key: "header",
-				Value: slog.GroupValue(headerLogField(r.Header)...)})
+			slog.Attr{Key: opts.fieldName("header"),
+				Value: slog.GroupValue(headerLogField(r.Header, opts.OnlyHeaders, opts)...)})
 	}
 
-	return slog.Group("httpRequest", requestFields...)
+	return slog.Attr{Key: opts.groupName("httpRequest"), Value: slog.GroupValue(requestFields...)}
 }
 
-func headerLogField(header http.Header) []slog.Attr {
+// headerLogField returns the header fields to log. If only isn't nil, only
+// headers matching its patterns are included.
+func headerLogField(header http.Header, only []string, opts *Options) []slog.Attr {
 	headerField := []slog.Attr{}
 	for k, v := range header {
 		k = strings.ToLower(k)
-		switch {
-		case len(v) == 0:
+		if len(v) == 0 {
 			continue
-		case len(v) == 1:
-			headerField = append(headerField, slog.Attr{Key: k, Value: slog.StringValue(v[0])})
-		default:
-			headerField = append(headerField, slog.Attr{Key: k,
-				Value: slog.StringValue(fmt.Sprintf("[%s]", strings.Join(v, "], [")))})
-			// headerField = fmt.Sprintf("[%s]", strings.Join(v, "], ["))
-		}
-		if k == "authorization" || k == "cookie" || k == "set-cookie" {
-			headerField[len(headerField)] = slog.Attr{
-				Key:   k,
-				Value: slog.StringValue("***"),
+		}
+		if only != nil && !slices.ContainsFunc(only, func(pattern string) bool { return matchHeader(pattern, k) }) {
+			continue
+		}
+		if k == "cookie" || k == "set-cookie" {
+			switch opts.CookieLogging {
+			case "omit":
+				continue
+			case "names":
+				v = cookieLogValues(k, v, opts.SafeCookies)
 			}
 		}
 
-		for _, skip := range DefaultOptions.SkipHeaders {
-			if k == skip {
-				headerField[len(headerField)] = slog.Attr{
-					Key:   k,
-					Value: slog.StringValue("***"),
-				}
-				break
+		values := make([]string, len(v))
+		for i, value := range v {
+			switch {
+			case slices.ContainsFunc(opts.SkipHeaders, func(pattern string) bool { return matchHeader(pattern, k) }):
+				value = "***"
+			case k == "authorization" && opts.AuthFingerprint:
+				value = authFingerprint(value)
+			case k == "authorization" || ((k == "cookie" || k == "set-cookie") && opts.CookieLogging != "names"):
+				value = "***"
+			default:
+				value = opts.mask(value)
 			}
+			values[i] = value
 		}
+		headerField = append(headerField, slog.Attr{Key: k, Value: headerValue(values)})
 	}
 	return headerField
 }
 
+// headerValue logs a single header value as a string, and repeated headers
+// as an array of all their values.
+func headerValue(values []string) slog.Value {
+	if len(values) == 1 {
+		return slog.StringValue(values[0])
+	}
+	return slog.AnyValue(values)
+}
+
+// cookieLogValues returns the values of the Cookie or Set-Cookie header named
+// k with the cookie values replaced by "***", except for safe cookies. The
+// attributes of Set-Cookie are dropped.
+func cookieLogValues(k string, values []string, safe []string) []string {
+	logValues := make([]string, 0, len(values))
+	for _, value := range values {
+		var cookies []string
+		if k == "set-cookie" {
+			cookie, _, _ := strings.Cut(value, ";")
+			cookies = []string{cookie}
+		} else {
+			cookies = strings.Split(value, ";")
+		}
+		for i, cookie := range cookies {
+			name, _, _ := strings.Cut(strings.TrimSpace(cookie), "=")
+			cookies[i] = name + "=***"
+			for _, s := range safe {
+				if name == s {
+					cookies[i] = strings.TrimSpace(cookie)
+					break
+				}
+			}
+		}
+		logValues = append(logValues, strings.Join(cookies, "; "))
+	}
+	return logValues
+}
+
 func statusLevel(status int) slog.Level {
 	switch {
 	case status <= 0:
@@ -257,6 +803,20 @@ func statusLevel(status int) slog.Level {
 	}
 }
 
+// durationValue represents d in the given DurationFieldUnit.
+func durationValue(d time.Duration, unit string) slog.Value {
+	switch unit {
+	case "s":
+		return slog.Float64Value(d.Seconds())
+	case "ns":
+		return slog.Int64Value(d.Nanoseconds())
+	case "string":
+		return slog.StringValue(d.String())
+	default:
+		return slog.Float64Value(float64(d.Nanoseconds()) / 1000000.0) // in milliseconds
+	}
+}
+
 func statusLabel(status int) string {
 	switch {
 	case status >= 100 && status < 300:
@@ -279,7 +839,7 @@ func statusLabel(status int) string {
 // passes through the handler chain, which at any point can be logged
 // with a call to .Print(), .Info(), etc.
 
-func LogEntry(ctx context.Context) slog.Logger {
+func LogEntry(ctx context.Context) *slog.Logger {
 	entry, ok := ctx.Value(middleware.LogEntryCtxKey).(*RequestLoggerEntry)
 	if !ok || entry == nil {
 		handlerOpts := &slog.HandlerOptions{
@@ -289,7 +849,7 @@ func LogEntry(ctx context.Context) slog.Logger {
 			Level: slog.LevelError + 1,
 			// ReplaceAttr: func(attr slog.Attr) slog.Attr ,
 		}
-		return *slog.New(handlerOpts.NewTextHandler(os.Stdout))
+		return slog.New(slog.NewTextHandler(os.Stdout, handlerOpts))
 	} else {
 		return entry.Logger
 	}
@@ -297,18 +857,50 @@ func LogEntry(ctx context.Context) slog.Logger {
 
 func LogEntrySetField(ctx context.Context, key, value string) {
 	if entry, ok := ctx.Value(middleware.LogEntryCtxKey).(*RequestLoggerEntry); ok {
-		entry.Logger = *entry.Logger.With(slog.Attr{Key: key, Value: slog.StringValue(value)})
+		entry.Logger = entry.Logger.With(slog.Attr{Key: key, Value: slog.StringValue(value)})
+	}
+}
+
+// SetError records err as the error of the request, see
+// RequestLoggerEntry.SetError.
+func SetError(ctx context.Context, err error) {
+	if entry, ok := ctx.Value(middleware.LogEntryCtxKey).(*RequestLoggerEntry); ok {
+		entry.SetError(err)
+	}
+}
+
+// KeepLogs makes the logs of the request be written with
+// Options.TailBuffering, see RequestLoggerEntry.KeepLogs.
+func KeepLogs(ctx context.Context) {
+	if entry, ok := ctx.Value(middleware.LogEntryCtxKey).(*RequestLoggerEntry); ok {
+		entry.KeepLogs()
 	}
 }
 
+// Entry returns the log entry of the request, nil outside of a request
+// logged by httplog. Its methods are safe to call on nil, so handlers can add
+// fields to the response log without checking, eg.
+//
+//	httplog.Entry(r.Context()).Add(slog.String("userID", userID))
+func Entry(ctx context.Context) *RequestLoggerEntry {
+	entry, _ := ctx.Value(middleware.LogEntryCtxKey).(*RequestLoggerEntry)
+	return entry
+}
+
+// LogEntryAdd adds attrs to the response log of the request, eg. a user ID
+// or whether the cache was hit, see RequestLoggerEntry.Add.
+func LogEntryAdd(ctx context.Context, attrs ...slog.Attr) {
+	Entry(ctx).Add(attrs...)
+}
+
 func LogEntrySetFields(ctx context.Context, fields map[string]interface{}) {
 	if entry, ok := ctx.Value(middleware.LogEntryCtxKey).(*RequestLoggerEntry); ok {
-		attrs := make([]slog.Attr, len(fields))
+		attrs := make([]any, len(fields))
 		i := 0
 		for k, v := range fields {
 			attrs[i] = slog.Attr{Key: k, Value: slog.AnyValue(v)}
 			i++
 		}
-		entry.Logger = *entry.Logger.With(attrs)
+		entry.Logger = entry.Logger.With(attrs...)
 	}
 }
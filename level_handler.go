@@ -0,0 +1,161 @@
+package httplog
+
+import (
+	"context"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+)
+
+// levelSplitHandler sends records at or above level to high and all others
+// to low, eg. to write warnings and errors to a separate stream.
+type levelSplitHandler struct {
+	level slog.Level
+	low   slog.Handler
+	high  slog.Handler
+}
+
+var _ slog.Handler = &levelSplitHandler{}
+
+func (h *levelSplitHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if level >= h.level {
+		return h.high.Enabled(ctx, level)
+	}
+	return h.low.Enabled(ctx, level)
+}
+
+func (h *levelSplitHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= h.level {
+		return h.high.Handle(ctx, r)
+	}
+	return h.low.Handle(ctx, r)
+}
+
+func (h *levelSplitHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelSplitHandler{level: h.level, low: h.low.WithAttrs(attrs), high: h.high.WithAttrs(attrs)}
+}
+
+func (h *levelSplitHandler) WithGroup(name string) slog.Handler {
+	return &levelSplitHandler{level: h.level, low: h.low.WithGroup(name), high: h.high.WithGroup(name)}
+}
+
+// minLevelHandler overrides the minimum level of handler with level.
+type minLevelHandler struct {
+	level   slog.Level
+	handler slog.Handler
+}
+
+var _ slog.Handler = &minLevelHandler{}
+
+func (h *minLevelHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *minLevelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler.Handle(ctx, r)
+}
+
+func (h *minLevelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &minLevelHandler{level: h.level, handler: h.handler.WithAttrs(attrs)}
+}
+
+func (h *minLevelHandler) WithGroup(name string) slog.Handler {
+	return &minLevelHandler{level: h.level, handler: h.handler.WithGroup(name)}
+}
+
+// stackTraceHandler attaches the goroutine's stack trace to records at error
+// level or above, except for the request and response logs written by the
+// middleware itself.
+type stackTraceHandler struct {
+	key     string
+	handler slog.Handler
+}
+
+var _ slog.Handler = &stackTraceHandler{}
+
+func (h *stackTraceHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *stackTraceHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelError && ctx.Value(middlewareLogCtxKey) == nil {
+		r = r.Clone()
+		r.AddAttrs(slog.String(h.key, string(debug.Stack())))
+	}
+	return h.handler.Handle(ctx, r)
+}
+
+func (h *stackTraceHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &stackTraceHandler{key: h.key, handler: h.handler.WithAttrs(attrs)}
+}
+
+func (h *stackTraceHandler) WithGroup(name string) slog.Handler {
+	return &stackTraceHandler{key: h.key, handler: h.handler.WithGroup(name)}
+}
+
+// tailBuffer holds the records of a request buffered by tailHandler until
+// the request is done and they're either flushed or dropped.
+type tailBuffer struct {
+	mu       sync.Mutex
+	records  []tailRecord
+	released bool
+	keep     bool
+	all      bool // buffer records below the level of the handler as well
+}
+
+type tailRecord struct {
+	ctx     context.Context
+	handler slog.Handler
+	record  slog.Record
+}
+
+// release ends buffering, writing the buffered records if flush or keep is
+// set and dropping them otherwise.
+func (b *tailBuffer) release(flush bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if flush || b.keep {
+		for _, rec := range b.records {
+			rec.handler.Handle(rec.ctx, rec.record)
+		}
+	}
+	b.records = nil
+	b.released = true
+}
+
+// tailHandler buffers the records of a request which handler is enabled for,
+// or all of them with tailBuffer.all, until the buffer is released.
+// Afterwards it passes records on to handler.
+type tailHandler struct {
+	buf     *tailBuffer
+	handler slog.Handler
+}
+
+var _ slog.Handler = &tailHandler{}
+
+func (h *tailHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	h.buf.mu.Lock()
+	defer h.buf.mu.Unlock()
+	return !h.buf.released && h.buf.all || h.handler.Enabled(ctx, level)
+}
+
+func (h *tailHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.buf.mu.Lock()
+	defer h.buf.mu.Unlock()
+	if h.buf.released {
+		return h.handler.Handle(ctx, r)
+	}
+	if !h.buf.all && !h.handler.Enabled(ctx, r.Level) {
+		return nil
+	}
+	h.buf.records = append(h.buf.records, tailRecord{ctx: ctx, handler: h.handler, record: r.Clone()})
+	return nil
+}
+
+func (h *tailHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &tailHandler{buf: h.buf, handler: h.handler.WithAttrs(attrs)}
+}
+
+func (h *tailHandler) WithGroup(name string) slog.Handler {
+	return &tailHandler{buf: h.buf, handler: h.handler.WithGroup(name)}
+}
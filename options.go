@@ -0,0 +1,399 @@
+package httplog
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// Option configures a Logger created with NewLogger. Options itself is an
+// Option which replaces the whole configuration, so it may be combined with
+// the With* functions below, eg.
+//
+//	httplog.NewLogger("api", httplog.Options{JSON: true}, httplog.WithLevel("debug"))
+type Option interface {
+	apply(opts *Options)
+}
+
+func (o Options) apply(opts *Options) {
+	*opts = o
+}
+
+// Clone returns a copy of the options which shares no maps or slices with o,
+// so it may be modified without affecting o.
+func (o Options) Clone() Options {
+	v := reflect.ValueOf(&o).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if f := v.Field(i); f.CanSet() {
+			f.Set(cloneValue(f))
+		}
+	}
+	return o
+}
+
+// With returns a copy of o with all fields which are set in overrides, ie.
+// not the zero value, replaced. Eg. to derive stricter options for an admin
+// router:
+//
+//	adminOpts := opts.With(httplog.Options{SkipHeaders: []string{"x-admin-token"}})
+//
+// Neither o nor overrides are modified. Maps and slices are replaced, not
+// merged, and boolean fields can only be switched on.
+func (o Options) With(overrides Options) Options {
+	merged := o.Clone()
+	v := reflect.ValueOf(&merged).Elem()
+	ov := reflect.ValueOf(overrides)
+	for i := 0; i < v.NumField(); i++ {
+		if f := ov.Field(i); !f.IsZero() && v.Field(i).CanSet() {
+			v.Field(i).Set(cloneValue(f))
+		}
+	}
+	return merged
+}
+
+// cloneValue returns a shallow copy of maps and slices in v, and v itself for
+// all other kinds.
+func cloneValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		m := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			m.SetMapIndex(iter.Key(), iter.Value())
+		}
+		return m
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		s := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(s, v)
+		return s
+	default:
+		return v
+	}
+}
+
+// DevOptions returns options suited to local development: pretty output with
+// full request details at debug level.
+func DevOptions() Options {
+	opts := DefaultOptions.Clone()
+	opts.LogLevel = "debug"
+	opts.JSON = false
+	opts.Concise = false
+	return opts
+}
+
+// ProdOptions returns options suited to production: concise JSON output at
+// info level, parsable by log aggregators.
+func ProdOptions() Options {
+	opts := DefaultOptions.Clone()
+	opts.LogLevel = "info"
+	opts.JSON = true
+	opts.Concise = true
+	return opts
+}
+
+// TestOptions returns options suited to tests, discarding all output.
+func TestOptions() Options {
+	opts := DefaultOptions.Clone()
+	opts.LogLevel = "debug"
+	opts.Writer = io.Discard
+	opts.ErrorWriter = nil
+	return opts
+}
+
+type optionFunc func(opts *Options)
+
+func (f optionFunc) apply(opts *Options) {
+	f(opts)
+}
+
+// WithLevel sets the minimum level of severity to log, see Options.LogLevel.
+func WithLevel(level string) Option {
+	return optionFunc(func(opts *Options) {
+		opts.LogLevel = level
+	})
+}
+
+// WithLevels defines additional named levels, see Options.Levels.
+func WithLevels(levels map[string]slog.Level) Option {
+	return optionFunc(func(opts *Options) {
+		merged := make(map[string]slog.Level, len(opts.Levels)+len(levels))
+		for k, v := range opts.Levels {
+			merged[k] = v
+		}
+		for k, v := range levels {
+			merged[k] = v
+		}
+		opts.Levels = merged
+	})
+}
+
+// WithRouteLevel overrides the log level for requests matching pattern, see
+// Options.RouteLevels.
+func WithRouteLevel(pattern, level string) Option {
+	return optionFunc(func(opts *Options) {
+		merged := make(map[string]string, len(opts.RouteLevels)+1)
+		for k, v := range opts.RouteLevels {
+			merged[k] = v
+		}
+		merged[pattern] = level
+		opts.RouteLevels = merged
+	})
+}
+
+// WithJSON enables structured logging output in json.
+func WithJSON() Option {
+	return optionFunc(func(opts *Options) {
+		opts.JSON = true
+	})
+}
+
+// WithConcise enables concise mode, see Options.Concise.
+func WithConcise() Option {
+	return optionFunc(func(opts *Options) {
+		opts.Concise = true
+	})
+}
+
+// WithFlatFields emits the request and response fields at the root of the
+// log record, see Options.FlatFields.
+func WithFlatFields() Option {
+	return optionFunc(func(opts *Options) {
+		opts.FlatFields = true
+	})
+}
+
+// WithSemConv renames the fields to the OpenTelemetry semantic conventions,
+// see Options.SemConv.
+func WithSemConv() Option {
+	return optionFunc(func(opts *Options) {
+		opts.SemConv = true
+	})
+}
+
+// WithService sets the service name and version logged with all logs.
+func WithService(name, version string) Option {
+	return optionFunc(func(opts *Options) {
+		opts.ServiceName = name
+		opts.ServiceVersion = version
+	})
+}
+
+// WithHostInfo includes the host name and pid in all logs.
+func WithHostInfo() Option {
+	return optionFunc(func(opts *Options) {
+		opts.IncludeHostInfo = true
+	})
+}
+
+// WithSchemaVersion includes the LogSchemaVersion in all logs.
+func WithSchemaVersion() Option {
+	return optionFunc(func(opts *Options) {
+		opts.SchemaVersion = true
+	})
+}
+
+// WithBodies logs request and/or response bodies up to maxBytes, see
+// Options.LogRequestBody and Options.LogResponseBody.
+func WithBodies(request, response bool, maxBytes int) Option {
+	return optionFunc(func(opts *Options) {
+		opts.LogRequestBody = request
+		opts.LogResponseBody = response
+		opts.BodyMaxBytes = maxBytes
+	})
+}
+
+// WithIDGenerator sets the generator of request IDs, eg. UUIDv7, see
+// Options.IDGenerator.
+func WithIDGenerator(fn func(r *http.Request) string) Option {
+	return optionFunc(func(opts *Options) {
+		opts.IDGenerator = fn
+	})
+}
+
+// WithTags adds tags to include at the root level of all logs. Tags set by
+// earlier options are kept unless overwritten by the same key.
+func WithTags(tags map[string]string) Option {
+	return optionFunc(func(opts *Options) {
+		merged := make(map[string]string, len(opts.Tags)+len(tags))
+		for k, v := range opts.Tags {
+			merged[k] = v
+		}
+		for k, v := range tags {
+			merged[k] = v
+		}
+		opts.Tags = merged
+	})
+}
+
+// WithAttrs adds fields to include at the root level of all logs.
+func WithAttrs(attrs ...slog.Attr) Option {
+	return optionFunc(func(opts *Options) {
+		merged := make([]slog.Attr, 0, len(opts.Attrs)+len(attrs))
+		merged = append(merged, opts.Attrs...)
+		opts.Attrs = append(merged, attrs...)
+	})
+}
+
+// WithDynamicTags sets a function computing additional fields per request,
+// see Options.DynamicTags.
+func WithDynamicTags(fn func(r *http.Request) []slog.Attr) Option {
+	return optionFunc(func(opts *Options) {
+		opts.DynamicTags = fn
+	})
+}
+
+// WithSkipPaths adds patterns of paths which are excluded from logging, see
+// Options.SkipPaths.
+func WithSkipPaths(patterns ...string) Option {
+	return optionFunc(func(opts *Options) {
+		skip := make([]string, 0, len(opts.SkipPaths)+len(patterns))
+		skip = append(skip, opts.SkipPaths...)
+		opts.SkipPaths = append(skip, patterns...)
+	})
+}
+
+// WithOnlyPaths adds patterns to the allowlist of logged paths, see
+// Options.OnlyPaths.
+func WithOnlyPaths(patterns ...string) Option {
+	return optionFunc(func(opts *Options) {
+		only := make([]string, 0, len(opts.OnlyPaths)+len(patterns))
+		only = append(only, opts.OnlyPaths...)
+		opts.OnlyPaths = append(only, patterns...)
+	})
+}
+
+// WithSkip sets a function deciding which response logs are left out, see
+// Options.Skip.
+func WithSkip(fn func(r *http.Request, status int, elapsed time.Duration) bool) Option {
+	return optionFunc(func(opts *Options) {
+		opts.Skip = fn
+	})
+}
+
+// WithSkipHeaders adds headers which are redacted from the logs.
+func WithSkipHeaders(headers ...string) Option {
+	return optionFunc(func(opts *Options) {
+		skip := make([]string, 0, len(opts.SkipHeaders)+len(headers))
+		skip = append(skip, opts.SkipHeaders...)
+		opts.SkipHeaders = append(skip, headers...)
+	})
+}
+
+// WithOnlyHeaders adds headers to the allowlist of logged headers, see
+// Options.OnlyHeaders.
+func WithOnlyHeaders(headers ...string) Option {
+	return optionFunc(func(opts *Options) {
+		only := make([]string, 0, len(opts.OnlyHeaders)+len(headers))
+		only = append(only, opts.OnlyHeaders...)
+		opts.OnlyHeaders = append(only, headers...)
+	})
+}
+
+// WithQuietDown excludes routes from logging for period after they were
+// logged, see Options.QuietDownRoutes.
+func WithQuietDown(period time.Duration, routes ...string) Option {
+	return optionFunc(func(opts *Options) {
+		quiet := make([]string, 0, len(opts.QuietDownRoutes)+len(routes))
+		quiet = append(quiet, opts.QuietDownRoutes...)
+		opts.QuietDownRoutes = append(quiet, routes...)
+		opts.QuietDownPeriod = period
+	})
+}
+
+// WithTimeField sets the name and format of the time field.
+func WithTimeField(name, format string) Option {
+	return optionFunc(func(opts *Options) {
+		opts.TimeFieldName = name
+		opts.TimeFieldFormat = format
+	})
+}
+
+// WithoutTime omits the time field from all logs.
+func WithoutTime() Option {
+	return optionFunc(func(opts *Options) {
+		opts.NoTime = true
+	})
+}
+
+// WithLevelFieldName sets the field name for the log level.
+func WithLevelFieldName(name string) Option {
+	return optionFunc(func(opts *Options) {
+		opts.LevelFieldName = name
+	})
+}
+
+// WithDurationField sets the field name and unit of the request duration,
+// see Options.DurationFieldUnit.
+func WithDurationField(name, unit string) Option {
+	return optionFunc(func(opts *Options) {
+		opts.DurationFieldName = name
+		opts.DurationFieldUnit = unit
+	})
+}
+
+// WithFieldNames renames fields httplog emits, see Options.FieldNames.
+// Renames set by earlier options are kept unless overwritten.
+func WithFieldNames(names map[string]string) Option {
+	return optionFunc(func(opts *Options) {
+		merged := make(map[string]string, len(opts.FieldNames)+len(names))
+		for k, v := range opts.FieldNames {
+			merged[k] = v
+		}
+		for k, v := range names {
+			merged[k] = v
+		}
+		opts.FieldNames = merged
+	})
+}
+
+// WithMessageFieldName sets the field name for the log message.
+func WithMessageFieldName(name string) Option {
+	return optionFunc(func(opts *Options) {
+		opts.MessageFieldName = name
+	})
+}
+
+// WithSourceFieldName enables logging the caller location under name.
+func WithSourceFieldName(name string) Option {
+	return optionFunc(func(opts *Options) {
+		opts.SourceFieldName = name
+	})
+}
+
+// WithWriter sets where logs are written to.
+func WithWriter(w io.Writer) Option {
+	return optionFunc(func(opts *Options) {
+		opts.Writer = w
+	})
+}
+
+// WithErrorWriter sets where warn and error level logs are written to.
+func WithErrorWriter(w io.Writer) Option {
+	return optionFunc(func(opts *Options) {
+		opts.ErrorWriter = w
+	})
+}
+
+// WithReplaceAttr sets a function to rewrite each attr before it's logged,
+// see Options.ReplaceAttr.
+func WithReplaceAttr(fn func(groups []string, a slog.Attr) slog.Attr) Option {
+	return optionFunc(func(opts *Options) {
+		opts.ReplaceAttr = fn
+	})
+}
+
+// WithNewHandler sets the function creating the slog.Handler writing logs,
+// see Options.NewHandler.
+func WithNewHandler(fn func(w io.Writer, opts *slog.HandlerOptions) slog.Handler) Option {
+	return optionFunc(func(opts *Options) {
+		opts.NewHandler = fn
+	})
+}
@@ -0,0 +1,43 @@
+package httplog
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spanTraceContext returns the trace context of the active OpenTelemetry span
+// in ctx, if any.
+func spanTraceContext(ctx context.Context) (traceContext, bool) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return traceContext{}, false
+	}
+	return traceContext{
+		traceID: sc.TraceID().String(),
+		spanID:  sc.SpanID().String(),
+		flags:   sc.TraceFlags().String(),
+	}, true
+}
+
+// recordSpan adds the response status and latency to span, as attributes or
+// as an event depending on Options.OTelSpan.
+func recordSpan(span trace.Span, mode string, status, bytes int, elapsed time.Duration) {
+	attrs := []attribute.KeyValue{
+		attribute.Int("http.response.status_code", status),
+		attribute.Int("http.response.body.size", bytes),
+		attribute.Float64("httplog.elapsed_ms", float64(elapsed.Nanoseconds())/1000000.0),
+	}
+	switch mode {
+	case "attributes":
+		span.SetAttributes(attrs...)
+	case "event":
+		span.AddEvent("httplog.response", trace.WithAttributes(attrs...))
+	}
+	if status >= 500 {
+		span.SetStatus(codes.Error, statusLabel(status))
+	}
+}
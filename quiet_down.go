@@ -0,0 +1,381 @@
+package httplog
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// QuietDownStore keeps the state of Options.QuietDownRoutes of a Logger, and
+// lets it be inspected and changed at runtime, eg. from an admin endpoint
+// during an incident. The store of the global logger set up by Configure is
+// QuietDown, that of other loggers is returned by Logger.QuietDown.
+//
+// Routes are named by their QuietDownRoutes entry, eg. "/metrics:2xx".
+type QuietDownStore struct {
+	// It's touched by every request to a quiet route, so the rules are
+	// spread over shards with a lock each, and each quiet period has a lock
+	// of its own.
+	shards [quietShards]quietShard
+
+	mu        sync.RWMutex
+	silenced  map[string]time.Time     // imposed with Silence, until when
+	routes    map[string]time.Duration // set with Logger.QuietRoute, zero if removed
+	persister QuietDownPersister
+	onError   func(error) // reports errors saving the state
+
+	suppressed sync.Map // map[string]*atomic.Uint64, requests suppressed per route
+}
+
+// QuietDown is the QuietDownStore of the global logger set up by Configure.
+var QuietDown = defaultLogger.QuietDown()
+
+// QuietDown returns the QuietDownStore of the logger.
+func (l *Logger) QuietDown() *QuietDownStore {
+	return &l.quiet
+}
+
+// QuietState describes an active quiet period.
+type QuietState struct {
+	Route      string    `json:"route"`      // the QuietDownRoutes entry, or as passed to Silence
+	Until      time.Time `json:"until"`      // when the quiet period ends
+	Suppressed int       `json:"suppressed"` // requests suppressed so far
+	Silenced   bool      `json:"silenced"`   // imposed with Silence
+}
+
+// Active returns the routes currently quiet, sorted by route.
+func (q *QuietDownStore) Active() []QuietState {
+	now := time.Now()
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	var active []QuietState
+	for i := range q.shards {
+		shard := &q.shards[i]
+		shard.mu.Lock()
+		for rule, s := range shard.routes {
+			if now.Before(s.until) {
+				s.mu.Lock()
+				silenced, ok := q.silenced[rule]
+				active = append(active, QuietState{
+					Route:      rule,
+					Until:      s.until,
+					Suppressed: s.total,
+					Silenced:   ok && silenced.Equal(s.until),
+				})
+				s.mu.Unlock()
+			}
+		}
+		shard.mu.Unlock()
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].Route < active[j].Route })
+	return active
+}
+
+// Stats returns the number of requests suppressed per route since the
+// logger was created, to quantify the traffic hidden by quiet-down. It may
+// be published with expvar, eg.
+//
+//	expvar.Publish("httplog_suppressed", expvar.Func(func() any { return httplog.QuietDown.Stats() }))
+func (q *QuietDownStore) Stats() map[string]uint64 {
+	stats := map[string]uint64{}
+	q.suppressed.Range(func(route, n any) bool {
+		stats[route.(string)] = n.(*atomic.Uint64).Load()
+		return true
+	})
+	return stats
+}
+
+// Reset ends the quiet period of route, so its next request is logged. It
+// also lifts a Silence.
+func (q *QuietDownStore) Reset(route string) {
+	q.mu.Lock()
+	delete(q.silenced, route)
+	q.mu.Unlock()
+
+	shard := q.shard(route)
+	shard.mu.Lock()
+	delete(shard.routes, route)
+	shard.mu.Unlock()
+	q.save()
+}
+
+// Silence quiets route for d from now on, whether or not it's one of the
+// QuietDownRoutes, replacing any quiet period it's in. The route may be a
+// pattern and status like a QuietDownRoutes entry. Server errors and panics
+// are still logged, see Options.SuppressErrors. No summary is logged for it.
+func (q *QuietDownStore) Silence(route string, d time.Duration) {
+	q.silence(route, time.Now().Add(d))
+	q.save()
+}
+
+func (q *QuietDownStore) silence(route string, until time.Time) {
+	q.mu.Lock()
+	if q.silenced == nil {
+		q.silenced = map[string]time.Time{}
+	}
+	for entry, end := range q.silenced {
+		if !end.After(time.Now()) {
+			delete(q.silenced, entry)
+		}
+	}
+	q.silenced[route] = until
+	q.mu.Unlock()
+
+	shard := q.shard(route)
+	shard.mu.Lock()
+	if shard.routes == nil {
+		shard.routes = map[string]*quietRoute{}
+	}
+	shard.routes[route] = &quietRoute{until: until}
+	shard.mu.Unlock()
+}
+
+// silencedRules returns the rules imposed with Silence matching routePath.
+func (q *QuietDownStore) silencedRules(routePath string, now time.Time) []quietRule {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	var rules []quietRule
+	for entry, until := range q.silenced {
+		if rule := parseQuietRule(entry); now.Before(until) && matchPath(rule.route, routePath) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+const quietShards = 16
+
+type quietShard struct {
+	mu     sync.Mutex
+	routes map[string]*quietRoute
+}
+
+func (q *QuietDownStore) shard(rule string) *quietShard {
+	h := fnv.New32a()
+	h.Write([]byte(rule))
+	return &q.shards[h.Sum32()%quietShards]
+}
+
+// quietRoute is the state of a rule during a quiet period.
+type quietRoute struct {
+	mu         sync.Mutex
+	until      time.Time // end of the quiet period
+	requests   int       // during the quiet period
+	suppressed int       // since the last logged request
+
+	// what was suppressed during the quiet period, for its summary
+	total     int
+	statuses  map[int]int
+	latencies []time.Duration // a sample of at most maxQuietLatencies
+}
+
+// maxQuietLatencies bounds the latencies kept per quiet period, sampled
+// uniformly beyond that.
+const maxQuietLatencies = 1024
+
+// check records a request matching the rule at now and reports whether it's
+// quiet, ie. the rule was logged within the last period. With every above
+// zero, every such request during the quiet period is logged anyway, along
+// with the number of requests suppressed since the last one logged. If the
+// request starts a new quiet period, its state is returned as started.
+func (q *QuietDownStore) check(rule string, period time.Duration, every, status int, elapsed time.Duration, now time.Time) (quiet bool, suppressed int, started *quietRoute) {
+	shard := q.shard(rule)
+	shard.mu.Lock()
+	s, ok := shard.routes[rule]
+	if !ok || !now.Before(s.until) {
+		if shard.routes == nil {
+			shard.routes = map[string]*quietRoute{}
+		}
+		s = &quietRoute{until: now.Add(period)}
+		shard.routes[rule] = s
+		shard.mu.Unlock()
+		return false, 0, s
+	}
+	shard.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if every > 0 && s.requests%every == 0 {
+		suppressed, s.suppressed = s.suppressed, 0
+		return false, suppressed, nil
+	}
+	s.suppressed++
+	s.total++
+	n, ok := q.suppressed.Load(rule)
+	if !ok {
+		n, _ = q.suppressed.LoadOrStore(rule, new(atomic.Uint64))
+	}
+	n.(*atomic.Uint64).Add(1)
+	if s.statuses == nil {
+		s.statuses = map[int]int{}
+	}
+	s.statuses[status]++
+	if len(s.latencies) < maxQuietLatencies {
+		s.latencies = append(s.latencies, elapsed)
+	} else if i := rand.Intn(s.total); i < maxQuietLatencies {
+		s.latencies[i] = elapsed
+	}
+	return true, 0, nil
+}
+
+// summary returns the fields of the summary of the quiet period s, or
+// nil if nothing was suppressed.
+func (s *quietRoute) summary(opts *Options) []slog.Attr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.total == 0 {
+		return nil
+	}
+	statuses := make([]slog.Attr, 0, len(s.statuses))
+	for status, n := range s.statuses {
+		statuses = append(statuses, slog.Int(strconv.Itoa(status), n))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Key < statuses[j].Key })
+
+	latencies := slices.Clone(s.latencies)
+	slices.Sort(latencies)
+	percentile := func(p int) slog.Value {
+		return durationValue(latencies[(len(latencies)-1)*p/100], opts.DurationFieldUnit)
+	}
+	return []slog.Attr{
+		slog.Int(opts.fieldName("suppressed"), s.total),
+		{Key: opts.fieldName("statuses"), Value: slog.GroupValue(statuses...)},
+		{Key: opts.fieldName("p50"), Value: percentile(50)},
+		{Key: opts.fieldName("p99"), Value: percentile(99)},
+	}
+}
+
+// quietRule is a parsed QuietDownRoutes entry, a route optionally followed by
+// the status it applies to, eg. "/metrics:200" or "/metrics:2xx".
+type quietRule struct {
+	rule   string // as written, keying its state
+	route  string
+	status string
+	period time.Duration // of the quiet periods, zero if only silenced
+}
+
+var quietStatus = regexp.MustCompile(`^[1-5]([0-9][0-9]|xx)$`)
+
+func parseQuietRule(rule string) quietRule {
+	if i := strings.LastIndexByte(rule, ':'); i >= 0 && quietStatus.MatchString(rule[i+1:]) {
+		return quietRule{rule: rule, route: rule[:i], status: rule[i+1:]}
+	}
+	return quietRule{rule: rule, route: rule}
+}
+
+// matchStatus reports whether the rule applies to responses with status.
+func (q quietRule) matchStatus(status int) bool {
+	switch {
+	case q.status == "":
+		return true
+	case strings.HasSuffix(q.status, "xx"):
+		return status/100 == int(q.status[0]-'0')
+	default:
+		return strconv.Itoa(status) == q.status
+	}
+}
+
+// QuietRoute adds pattern to the QuietDownRoutes of the logger at runtime,
+// quieting it for period after it was logged, eg. to silence a noisy route
+// discovered during an incident without redeploying. It may also change the
+// period of one of the QuietDownRoutes. The pattern is written like a
+// QuietDownRoutes entry. It's kept when the logger is configured again.
+func (l *Logger) QuietRoute(pattern string, period time.Duration) error {
+	if err := validPathPattern(parseQuietRule(pattern).route); err != nil {
+		return fmt.Errorf("httplog: malformed QuietDownRoutes pattern %q: %w", pattern, err)
+	}
+	if period <= 0 {
+		return fmt.Errorf("httplog: invalid quiet-down period %s", period)
+	}
+	l.quiet.setRoute(pattern, period)
+	return nil
+}
+
+// UnquietRoute removes pattern from the QuietDownRoutes of the logger at
+// runtime, whether it was added with QuietRoute or is in its Options, and
+// ends its quiet period.
+func (l *Logger) UnquietRoute(pattern string) {
+	l.quiet.setRoute(pattern, 0)
+	l.quiet.Reset(pattern)
+}
+
+func (q *QuietDownStore) setRoute(pattern string, period time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.routes == nil {
+		q.routes = map[string]time.Duration{}
+	}
+	q.routes[pattern] = period
+}
+
+// quietRules returns the QuietDownRoutes rules for the route of r, as changed
+// with Logger.QuietRoute and Logger.UnquietRoute, followed by those imposed
+// with QuietDownStore.Silence.
+func (l *Logger) quietRules(r *http.Request, opts *Options) []quietRule {
+	routePath := r.URL.EscapedPath()
+	if routePath == "" {
+		routePath = "/"
+	}
+	l.quiet.mu.RLock()
+	runtime := l.quiet.routes
+	var rules []quietRule
+	for _, entry := range opts.QuietDownRoutes {
+		period, changed := runtime[entry]
+		if !changed {
+			period = opts.QuietDownPeriod
+		}
+		if rule := parseQuietRule(entry); period > 0 && matchPath(rule.route, routePath) {
+			rule.period = period
+			rules = append(rules, rule)
+		}
+	}
+	for entry, period := range runtime {
+		if rule := parseQuietRule(entry); period > 0 && !slices.Contains(opts.QuietDownRoutes, entry) && matchPath(rule.route, routePath) {
+			rule.period = period
+			rules = append(rules, rule)
+		}
+	}
+	l.quiet.mu.RUnlock()
+	return append(rules, l.quiet.silencedRules(routePath, time.Now())...)
+}
+
+// quietDown reports whether a response with status is quieted by any of the
+// rules, see QuietDownStore.check. When a quiet period ends, a summary of the
+// requests suppressed during it is logged.
+func (l *Logger) quietDown(rules []quietRule, status int, elapsed time.Duration, opts *Options) (quiet bool, suppressed int) {
+	for _, rule := range rules {
+		if !rule.matchStatus(status) {
+			continue
+		}
+		quiet, suppressed, started := l.quiet.check(rule.rule, rule.period, opts.QuietDownSampleEvery, status, elapsed, time.Now())
+		if started != nil {
+			l.quiet.save()
+		}
+		if started != nil && rule.period > 0 {
+			time.AfterFunc(rule.period, func() {
+				if attrs := started.summary(opts); attrs != nil {
+					attrs = append([]slog.Attr{slog.String(opts.fieldName("route"), rule.rule)}, attrs...)
+					logAttrs(context.Background(), l.Logger, opts, 0, slog.LevelInfo,
+						fmt.Sprintf("Quiet period of %s ended", rule.rule), attrs...)
+				}
+			})
+		}
+		return quiet, suppressed
+	}
+	return false, 0
+}
@@ -0,0 +1,148 @@
+package httplog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer collects the logs written concurrently.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// responseLogs counts the response logs per request path.
+func (b *lockedBuffer) responseLogs(t *testing.T) map[string]int {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	counts := map[string]int{}
+	scanner := bufio.NewScanner(bytes.NewReader(b.buf.Bytes()))
+	for scanner.Scan() {
+		var line struct {
+			HTTPRequest struct {
+				RequestPath string `json:"requestPath"`
+			} `json:"httpRequest"`
+			HTTPResponse *struct{} `json:"httpResponse"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("malformed log line %q: %v", scanner.Text(), err)
+		}
+		if line.HTTPResponse != nil {
+			counts[line.HTTPRequest.RequestPath]++
+		}
+	}
+	return counts
+}
+
+func newQuietLogger(out *lockedBuffer, routes ...string) (*Logger, http.Handler) {
+	logger := NewLogger("test", Options{
+		JSON:            true,
+		Concise:         true,
+		QuietDownRoutes: routes,
+		QuietDownPeriod: time.Hour,
+		Writer:          out,
+	})
+	handler := Handler(logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	return logger, handler
+}
+
+func serve(handler http.Handler, path string) {
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+}
+
+func TestQuietDownConcurrentRequests(t *testing.T) {
+	var out lockedBuffer
+	logger, handler := newQuietLogger(&out, "/quiet")
+
+	const workers, requests = 16, 50
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < requests; j++ {
+				serve(handler, "/quiet")
+				serve(handler, "/loud")
+			}
+		}()
+	}
+	// change and inspect the quiet-down state while requests are served
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < requests; j++ {
+			if err := logger.QuietRoute("/runtime", time.Hour); err != nil {
+				t.Error(err)
+			}
+			serve(handler, "/runtime")
+			logger.QuietDown().Active()
+			logger.QuietDown().Stats()
+			logger.QuietDown().Reset("/runtime")
+			logger.UnquietRoute("/runtime")
+		}
+	}()
+	wg.Wait()
+
+	counts := out.responseLogs(t)
+	if got := counts["/quiet"]; got != 1 {
+		t.Errorf("logged /quiet %d times, want once", got)
+	}
+	if got, want := counts["/loud"], workers*requests; got != want {
+		t.Errorf("logged /loud %d times, want %d", got, want)
+	}
+	if got, want := logger.QuietDown().Stats()["/quiet"], uint64(workers*requests-1); got != want {
+		t.Errorf("suppressed %d requests to /quiet, want %d", got, want)
+	}
+}
+
+func TestQuietRouteAtRuntime(t *testing.T) {
+	var out lockedBuffer
+	logger, handler := newQuietLogger(&out)
+
+	if err := logger.QuietRoute("/runtime", 0); err == nil {
+		t.Error("QuietRoute accepted a zero period")
+	}
+	if err := logger.QuietRoute("/runtime", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	serve(handler, "/runtime")
+	serve(handler, "/runtime")
+	if got := out.responseLogs(t)["/runtime"]; got != 1 {
+		t.Fatalf("logged /runtime %d times after QuietRoute, want once", got)
+	}
+	if active := logger.QuietDown().Active(); len(active) != 1 || active[0].Route != "/runtime" || active[0].Suppressed != 1 {
+		t.Errorf("Active() = %+v, want /runtime with 1 suppressed", active)
+	}
+
+	logger.QuietDown().Reset("/runtime")
+	serve(handler, "/runtime")
+	serve(handler, "/runtime")
+	if got := out.responseLogs(t)["/runtime"]; got != 2 {
+		t.Fatalf("logged /runtime %d times after Reset, want twice", got)
+	}
+
+	logger.UnquietRoute("/runtime")
+	serve(handler, "/runtime")
+	serve(handler, "/runtime")
+	if got := out.responseLogs(t)["/runtime"]; got != 4 {
+		t.Errorf("logged /runtime %d times after UnquietRoute, want 4 times", got)
+	}
+	if active := logger.QuietDown().Active(); len(active) != 0 {
+		t.Errorf("Active() = %+v after UnquietRoute, want none", active)
+	}
+}
@@ -0,0 +1,118 @@
+package httplog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// QuietDownPersister saves and restores the quiet periods of a Logger, so a
+// restart doesn't log noisy routes again for another full period, see
+// Options.QuietDownPersister.
+type QuietDownPersister interface {
+	// Load returns the quiet periods saved last, none if nothing was saved.
+	Load() ([]QuietState, error)
+	// Save replaces the saved quiet periods with active ones.
+	Save(active []QuietState) error
+}
+
+// QuietDownFile returns a QuietDownPersister keeping the quiet periods in a
+// JSON file at path. The file is replaced atomically on every save.
+func QuietDownFile(path string) QuietDownPersister {
+	return &quietDownFile{path: path}
+}
+
+type quietDownFile struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (f *quietDownFile) Load() ([]QuietState, error) {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var states []QuietState
+	if err := json.Unmarshal(data, &states); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", f.path, err)
+	}
+	return states, nil
+}
+
+func (f *quietDownFile) Save(active []QuietState) error {
+	data, err := json.Marshal(active)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// setPersister makes the store save its quiet periods with p, restoring the
+// saved ones the first time a persister is set.
+func (q *QuietDownStore) setPersister(p QuietDownPersister, onError func(error)) {
+	q.mu.Lock()
+	first := q.persister == nil
+	q.persister, q.onError = p, onError
+	q.mu.Unlock()
+	if p == nil || !first {
+		return
+	}
+
+	states, err := p.Load()
+	if err != nil {
+		onError(err)
+		return
+	}
+	now := time.Now()
+	for _, s := range states {
+		if !now.Before(s.Until) {
+			continue
+		}
+		if s.Silenced {
+			q.silence(s.Route, s.Until)
+			continue
+		}
+		shard := q.shard(s.Route)
+		shard.mu.Lock()
+		if shard.routes == nil {
+			shard.routes = map[string]*quietRoute{}
+		}
+		shard.routes[s.Route] = &quietRoute{until: s.Until}
+		shard.mu.Unlock()
+	}
+}
+
+// save saves the active quiet periods with the persister, if any.
+func (q *QuietDownStore) save() {
+	q.mu.RLock()
+	p, onError := q.persister, q.onError
+	q.mu.RUnlock()
+	if p == nil {
+		return
+	}
+	if err := p.Save(q.Active()); err != nil && onError != nil {
+		onError(err)
+	}
+}
@@ -0,0 +1,44 @@
+package httplog
+
+import (
+	"sync"
+	"time"
+)
+
+// routeLimiter keeps a token bucket per route for Options.RouteRateLimit.
+type routeLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens     float64
+	last       time.Time
+	suppressed int
+}
+
+// allow takes a token from the bucket of route, which refills at rate tokens
+// per second up to a burst of rate. When it lets a line through after
+// suppressing some, it returns their number so they can be reported.
+func (l *routeLimiter) allow(route string, rate float64, now time.Time) (ok bool, suppressed int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, found := l.buckets[route]
+	if !found {
+		if l.buckets == nil {
+			l.buckets = map[string]*tokenBucket{}
+		}
+		b = &tokenBucket{tokens: max(rate, 1), last: now}
+		l.buckets[route] = b
+	}
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*rate, max(rate, 1))
+	b.last = now
+	if b.tokens < 1 {
+		b.suppressed++
+		return false, 0
+	}
+	b.tokens--
+	suppressed, b.suppressed = b.suppressed, 0
+	return true, suppressed
+}
@@ -0,0 +1,76 @@
+package httplog
+
+import (
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Recoverer is an http middleware recovering from panics in the handlers
+// below it. The panic value and stack trace are logged with the response by
+// Handler, which has to come first in the chain, and a 500 is sent if the
+// response wasn't started yet. Panics with http.ErrAbortHandler are passed
+// on, as they're meant to abort the response quietly.
+//
+// It can be used in place of chi's middleware.Recoverer, and is included in
+// RequestLogger.
+func Recoverer(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rvr := recover()
+			if rvr == nil {
+				return
+			}
+			if rvr == http.ErrAbortHandler {
+				panic(rvr)
+			}
+
+			if entry := middleware.GetLogEntry(r); entry != nil {
+				entry.Panic(rvr, debug.Stack())
+			} else {
+				middleware.PrintPrettyStack(rvr)
+			}
+
+			if r.Header.Get("Connection") != "Upgrade" {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// stackFrame is a frame of a parsed stack trace.
+type stackFrame struct {
+	Function string `json:"function"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+}
+
+// parseStack parses the frames of a stack trace as formatted by debug.Stack,
+// leaving out the frames of debug.Stack itself.
+func parseStack(stack []byte) []stackFrame {
+	var frames []stackFrame
+	lines := strings.Split(string(stack), "\n")
+	for i := 1; i+1 < len(lines); i += 2 {
+		function, location := lines[i], strings.TrimSpace(lines[i+1])
+		if paren := strings.LastIndexByte(function, '('); paren > 0 {
+			function = function[:paren]
+		}
+		if function == "runtime/debug.Stack" || strings.HasPrefix(function, "created by ") {
+			continue
+		}
+		location, _, _ = strings.Cut(location, " +0x")
+		frame := stackFrame{Function: function, File: location}
+		if colon := strings.LastIndexByte(location, ':'); colon > 0 {
+			frame.File = location[:colon]
+			frame.Line, _ = strconv.Atoi(location[colon+1:])
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
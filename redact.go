@@ -0,0 +1,140 @@
+package httplog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// redacted replaces the values of redacted fields.
+const redacted = "[redacted]"
+
+// MaskRule masks all matches of Pattern in logged header values, request
+// URLs and bodies, replacing them with Replacement, or "[masked]" if empty.
+// Replacement may refer to submatches as in regexp.Regexp.ReplaceAllString.
+type MaskRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// BuiltinMasks are the mask rules which can be enabled by name with
+// Options.Masks.
+var BuiltinMasks = map[string]MaskRule{
+	"creditcard": {Pattern: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`)},
+	"email":      {Pattern: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)},
+	"bearer":     {Pattern: regexp.MustCompile(`(?i)\b(bearer)\s+[A-Za-z0-9._~+/-]+=*`), Replacement: "$1 [masked]"},
+}
+
+// mask applies the Masks and MaskRules to s.
+func (o *Options) mask(s string) string {
+	for _, name := range o.Masks {
+		if rule, ok := BuiltinMasks[name]; ok {
+			s = rule.apply(s)
+		}
+	}
+	for _, rule := range o.MaskRules {
+		s = rule.apply(s)
+	}
+	return s
+}
+
+func (r MaskRule) apply(s string) string {
+	if r.Pattern == nil {
+		return s
+	}
+	replacement := r.Replacement
+	if replacement == "" {
+		replacement = "[masked]"
+	}
+	return r.Pattern.ReplaceAllString(s, replacement)
+}
+
+// isJSON reports whether contentType is application/json or a +json type.
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// redactJSON replaces the values at paths in the JSON document body with
+// "[redacted]". Paths are dot separated object keys, where "*" matches any
+// key, and arrays are descended into transparently, so "items.*.token"
+// matches the token of all objects in the items array.
+func redactJSON(body []byte, paths []string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		doc = redactJSONPath(doc, strings.Split(p, "."))
+	}
+	return json.Marshal(doc)
+}
+
+func redactJSONPath(v any, path []string) any {
+	if len(path) == 0 {
+		return redacted
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if path[0] == "*" || path[0] == key {
+				v[key] = redactJSONPath(value, path[1:])
+			}
+		}
+	case []any:
+		for i, value := range v {
+			v[i] = redactJSONPath(value, path)
+		}
+	}
+	return v
+}
+
+// redactQuery replaces the values of the params in the request URI uri with
+// "***", keeping the order and encoding of the other parameters intact.
+// Parameter names are matched case-insensitively.
+func redactQuery(uri string, params []string) string {
+	path, query, ok := strings.Cut(uri, "?")
+	if !ok || len(params) == 0 {
+		return uri
+	}
+	pairs := strings.Split(query, "&")
+	for i, pair := range pairs {
+		key, _, _ := strings.Cut(pair, "=")
+		if name, err := url.QueryUnescape(key); err == nil {
+			key = name
+		}
+		for _, param := range params {
+			if strings.EqualFold(key, param) {
+				pairs[i] = pair[:strings.IndexByte(pair+"=", '=')] + "=***"
+				break
+			}
+		}
+	}
+	return path + "?" + strings.Join(pairs, "&")
+}
+
+// authFingerprint replaces the credentials of an Authorization header value
+// by the first bytes of their SHA-256 hash, keeping the scheme, eg.
+// "Bearer sha256:ab12cd34…".
+func authFingerprint(value string) string {
+	scheme, credentials, ok := strings.Cut(strings.TrimSpace(value), " ")
+	if !ok {
+		scheme, credentials = "", scheme
+	}
+	sum := sha256.Sum256([]byte(strings.TrimSpace(credentials)))
+	fingerprint := "sha256:" + hex.EncodeToString(sum[:4]) + "…"
+	if scheme == "" {
+		return fingerprint
+	}
+	return scheme + " " + fingerprint
+}
@@ -0,0 +1,147 @@
+package httplog
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// RequestID is an http middleware assigning each request a unique ID, which
+// Handler logs as the requestID field and handlers can get with
+// GetRequestID. It's the counterpart of chi's middleware.RequestID for
+// routers other than chi, and sets the ID for middleware.GetReqID as well.
+//
+// An ID passed in by the client in the Options.RequestIDHeader is reused, and
+// with Options.EchoRequestID the ID is sent back in the same header.
+func RequestID(logger *Logger) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			opts := logger.opts.Load()
+			var id string
+			if opts.RequestIDHeader != "-" {
+				id = r.Header.Get(opts.RequestIDHeader)
+			}
+			if !validRequestID(id) {
+				if opts.IDGenerator != nil {
+					id = opts.IDGenerator(r)
+				} else {
+					id = newRequestID()
+				}
+			}
+			if opts.EchoRequestID {
+				header := opts.RequestIDHeader
+				if header == "-" {
+					header = "X-Request-Id"
+				}
+				w.Header().Set(header, id)
+			}
+			ctx := context.WithValue(r.Context(), requestIDCtxKey, id)
+			ctx = context.WithValue(ctx, middleware.RequestIDKey, id)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// RequestID returns the request ID middleware for the logger, see RequestID.
+func (l *Logger) RequestID() func(next http.Handler) http.Handler {
+	return RequestID(l)
+}
+
+// GetRequestID returns the request ID set by the RequestID middleware, or
+// by chi's middleware.RequestID, if any.
+func GetRequestID(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDCtxKey).(string); ok {
+		return id
+	}
+	return middleware.GetReqID(ctx)
+}
+
+// validRequestID reports whether an incoming request ID is safe to reuse.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random 128-bit ID in hex.
+func newRequestID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// UUIDv4 is an Options.IDGenerator generating random UUIDs (RFC 9562).
+func UUIDv4(*http.Request) string {
+	var uuid [16]byte
+	rand.Read(uuid[:])
+	uuid[6] = uuid[6]&0x0f | 0x40 // version 4
+	uuid[8] = uuid[8]&0x3f | 0x80 // variant 10
+	return formatUUID(uuid)
+}
+
+// UUIDv7 is an Options.IDGenerator generating time-ordered UUIDs (RFC 9562),
+// which sort by the time of the request.
+func UUIDv7(*http.Request) string {
+	var uuid [16]byte
+	rand.Read(uuid[6:])
+	putMillis(uuid[:6], time.Now())
+	uuid[6] = uuid[6]&0x0f | 0x70 // version 7
+	uuid[8] = uuid[8]&0x3f | 0x80 // variant 10
+	return formatUUID(uuid)
+}
+
+// ULID is an Options.IDGenerator generating ULIDs, 26 character
+// lexicographically sortable IDs of a millisecond timestamp and 80 random
+// bits.
+func ULID(*http.Request) string {
+	const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+	var id [16]byte
+	putMillis(id[:6], time.Now())
+	rand.Read(id[6:])
+
+	// encode the 128 bits as 26 base32 digits, the first taking 3 bits
+	hi, lo := binary.BigEndian.Uint64(id[:8]), binary.BigEndian.Uint64(id[8:])
+	var out [26]byte
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// putMillis puts the 48-bit Unix millisecond timestamp of t into b.
+func putMillis(b []byte, t time.Time) {
+	ms := uint64(t.UnixMilli())
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+}
+
+func formatUUID(uuid [16]byte) string {
+	var buf [36]byte
+	hex.Encode(buf[0:8], uuid[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], uuid[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], uuid[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], uuid[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], uuid[10:])
+	return string(buf[:])
+}
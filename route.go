@@ -0,0 +1,65 @@
+package httplog
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// routePattern returns the route pattern the router matched r with, eg.
+// "/users/{id}", from chi's RouteContext or the Request.Pattern of
+// http.ServeMux (Go 1.23+). It's only complete once the handler returned.
+func routePattern(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		if pattern := rctx.RoutePattern(); pattern != "" {
+			return pattern
+		}
+	}
+	return requestPattern(r)
+}
+
+// PathRule rewrites logged paths, replacing all matches of Pattern with
+// Replacement as in regexp.Regexp.ReplaceAllString, eg.
+//
+//	httplog.PathRule{Pattern: regexp.MustCompile(`^/files/.*`), Replacement: "/files/*"}
+type PathRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+var (
+	uuidSegment = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hashSegment = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+)
+
+// normalizePath collapses the variable parts of p with the PathRules and,
+// with NormalizePaths, numeric, UUID and hash segments into ":id", ":uuid"
+// and ":hash". It returns "" if neither is configured.
+func (o *Options) normalizePath(p string) string {
+	if len(o.PathRules) == 0 && !o.NormalizePaths {
+		return ""
+	}
+	for _, rule := range o.PathRules {
+		if rule.Pattern != nil {
+			p = rule.Pattern.ReplaceAllString(p, rule.Replacement)
+		}
+	}
+	if o.NormalizePaths {
+		segments := strings.Split(p, "/")
+		for i, segment := range segments {
+			switch {
+			case segment == "" || strings.HasPrefix(segment, ":"):
+			case strings.Trim(segment, "0123456789") == "":
+				segments[i] = ":id"
+			case uuidSegment.MatchString(segment):
+				segments[i] = ":uuid"
+			case hashSegment.MatchString(segment):
+				segments[i] = ":hash"
+			}
+		}
+		p = strings.Join(segments, "/")
+	}
+	return p
+}
@@ -0,0 +1,10 @@
+//go:build !go1.23
+
+package httplog
+
+import "net/http"
+
+// requestPattern is a no-op before Go 1.23, which added Request.Pattern.
+func requestPattern(r *http.Request) string {
+	return ""
+}
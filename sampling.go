@@ -0,0 +1,25 @@
+package httplog
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net/http"
+)
+
+// sampleRequest decides whether the request is logged with
+// Options.SampleRate. The decision is derived from the request ID if there
+// is one, so it's the same for every line of the request and for every
+// service passing the ID along.
+func sampleRequest(r *http.Request, rate float64) bool {
+	if rate <= 0 || rate >= 1 {
+		return true
+	}
+	id := GetRequestID(r.Context())
+	if id == "" {
+		return rand.Float64() < rate
+	}
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return float64(h.Sum64()) < rate*math.MaxUint64
+}
@@ -0,0 +1,94 @@
+package httplog
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// pkgPrefix is the prefix of the names of all functions in this package,
+// eg. "github.com/piscopoc/httplog/v2.".
+var pkgPrefix = reflect.TypeOf(Options{}).PkgPath() + "."
+
+type ctxKey int
+
+const (
+	// middlewareLogCtxKey marks the context of logs written by the middleware
+	// itself, as opposed to those written by handlers through LogEntry.
+	middlewareLogCtxKey ctxKey = iota
+
+	// requestIDCtxKey holds the request ID set by the RequestID middleware.
+	requestIDCtxKey
+
+	// connStateCtxKey holds the connState set by ConnContext.
+	connStateCtxKey
+
+	// mustLogCtxKey marks the context of response logs which bypass the
+	// noise controls, see Options.SuppressErrors.
+	mustLogCtxKey
+)
+
+// logAttrs is like logger.LogAttrs for logs written by the middleware, but
+// when source logging is enabled it attributes the record to pc, usually the
+// handlerPC of the next handler, instead of the middleware itself. Without pc
+// it's the first caller outside of httplog, skipping another
+// opts.SourceCallerSkip frames.
+func logAttrs(ctx context.Context, logger *slog.Logger, opts *Options, pc uintptr, level slog.Level, msg string, attrs ...slog.Attr) {
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	ctx = context.WithValue(ctx, middlewareLogCtxKey, true)
+	if opts.SourceFieldName == "" {
+		pc = 0
+	} else if pc == 0 {
+		pc = callerPC(opts.SourceCallerSkip)
+	}
+	r := slog.NewRecord(time.Now(), level, msg, pc)
+	r.AddAttrs(attrs...)
+	_ = logger.Handler().Handle(ctx, r)
+}
+
+// callerPC returns the program counter of the first caller outside of httplog
+// and the runtime, after skipping skip more frames.
+func callerPC(skip int) uintptr {
+	var pcs [64]uintptr
+	n := runtime.Callers(2, pcs[:])
+	// walk the frames of all pcs at once, which expands inlined calls
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		f, more := frames.Next()
+		if !strings.HasPrefix(f.Function, pkgPrefix) && !strings.HasPrefix(f.Function, "runtime.") {
+			if skip <= 0 {
+				// like the return addresses of runtime.Callers, after the call
+				return f.PC + 1
+			}
+			skip--
+		}
+		if !more {
+			return 0
+		}
+	}
+}
+
+// handlerPC returns the program counter of the code of h, to attribute the
+// logs the middleware writes for it to: the function of an http.HandlerFunc,
+// or else the ServeHTTP method of its type.
+func handlerPC(h http.Handler) uintptr {
+	var entry uintptr
+	if f, ok := h.(http.HandlerFunc); ok {
+		entry = reflect.ValueOf(f).Pointer()
+	} else if h != nil {
+		if m, ok := reflect.TypeOf(h).MethodByName("ServeHTTP"); ok {
+			entry = m.Func.Pointer()
+		}
+	}
+	if entry == 0 {
+		return 0
+	}
+	// past the entry, as runtime.CallersFrames looks up the pc before
+	return entry + 1
+}
@@ -0,0 +1,78 @@
+package httplog
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+)
+
+// swapHandler is a slog.Handler whose underlying handler may be replaced at
+// any time, even while it's in use. Handlers derived from it with WithAttrs
+// and WithGroup share the same root and pick up the replacement as well,
+// which is what lets Logger.Configure take effect on request loggers created
+// before it was called.
+type swapHandler struct {
+	root *atomic.Pointer[slog.Handler]
+	ops  []func(slog.Handler) slog.Handler
+
+	// cache holds the root handler with ops applied, along with the root it
+	// was built from so a swap invalidates it.
+	cache atomic.Pointer[swapCache]
+}
+
+type swapCache struct {
+	root    *slog.Handler
+	handler slog.Handler
+}
+
+var _ slog.Handler = &swapHandler{}
+
+func newSwapHandler(h slog.Handler) *swapHandler {
+	sh := &swapHandler{root: &atomic.Pointer[slog.Handler]{}}
+	sh.swap(h)
+	return sh
+}
+
+// swap replaces the underlying handler of h and all handlers derived from it.
+func (h *swapHandler) swap(handler slog.Handler) {
+	h.root.Store(&handler)
+}
+
+func (h *swapHandler) handler() slog.Handler {
+	root := h.root.Load()
+	if c := h.cache.Load(); c != nil && c.root == root {
+		return c.handler
+	}
+	handler := *root
+	for _, op := range h.ops {
+		handler = op(handler)
+	}
+	h.cache.Store(&swapCache{root: root, handler: handler})
+	return handler
+}
+
+func (h *swapHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler().Enabled(ctx, level)
+}
+
+func (h *swapHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler().Handle(ctx, r)
+}
+
+func (h *swapHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler {
+		return handler.WithAttrs(attrs)
+	})
+}
+
+func (h *swapHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler {
+		return handler.WithGroup(name)
+	})
+}
+
+func (h *swapHandler) with(op func(slog.Handler) slog.Handler) *swapHandler {
+	ops := make([]func(slog.Handler) slog.Handler, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return &swapHandler{root: h.root, ops: append(ops, op)}
+}
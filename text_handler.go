@@ -2,20 +2,22 @@ package httplog
 
 import (
 	"bytes"
+	"context"
 	"io"
+	"log/slog"
+	"runtime"
+	"strings"
 	"sync"
 	"time"
-
-	"golang.org/x/exp/slog"
 )
 
 type PrettyHandler struct {
-	mu                sync.Mutex
+	mu                *sync.Mutex
 	opts              *slog.HandlerOptions
 	w                 io.Writer
 	preformattedAttrs *bytes.Buffer
-	groupPrefix       *string
-	groupOpen         bool
+	groups            []string
+	useColor          bool
 }
 
 var DefaultHandlerConfig = &slog.HandlerOptions{
@@ -35,13 +37,14 @@ func NewPrettyHandler(w io.Writer, op ...*slog.HandlerOptions) *PrettyHandler {
 		opts:              config,
 		w:                 w,
 		preformattedAttrs: &bytes.Buffer{},
-		mu:                sync.Mutex{},
+		mu:                &sync.Mutex{},
+		useColor:          isTerminal(w),
 	}
 }
 
 var _ slog.Handler = &PrettyHandler{}
 
-func (h *PrettyHandler) Enabled(level slog.Level) bool {
+func (h *PrettyHandler) Enabled(_ context.Context, level slog.Level) bool {
 	minLevel := slog.LevelInfo
 	if h.opts.Level != nil {
 		minLevel = h.opts.Level.Level()
@@ -49,7 +52,7 @@ func (h *PrettyHandler) Enabled(level slog.Level) bool {
 	return level >= minLevel
 }
 
-func (h *PrettyHandler) Handle(r slog.Record) error {
+func (h *PrettyHandler) Handle(_ context.Context, r slog.Record) error {
 	buf := &bytes.Buffer{}
 
 	if !r.Time.IsZero() {
@@ -58,41 +61,69 @@ func (h *PrettyHandler) Handle(r slog.Record) error {
 			Value: slog.TimeValue(r.Time),
 		}
 		if h.opts.ReplaceAttr != nil {
-			timeAttr = h.opts.ReplaceAttr([]string{}, timeAttr)
+			timeAttr = h.opts.ReplaceAttr(nil, timeAttr)
 		} else {
 			timeAttr.Value = slog.StringValue(timeAttr.Value.Time().Format(time.RFC3339Nano))
 		}
 		// write time, level and source to buf
-		cW(buf, true, nGreen, "%s", timeAttr.Value.String())
-		buf.WriteString(" ")
+		if timeAttr.Key != "" {
+			cW(buf, h.useColor, nGreen, "%s", timeAttr.Value.String())
+			buf.WriteString(" ")
+		}
 	}
 
 	levelAttr := slog.Attr{
 		Key:   slog.LevelKey,
-		Value: slog.StringValue(r.Level.String()),
+		Value: slog.AnyValue(r.Level),
 	}
 	if h.opts.ReplaceAttr != nil {
-		levelAttr = h.opts.ReplaceAttr([]string{}, levelAttr)
+		levelAttr = h.opts.ReplaceAttr(nil, levelAttr)
+	} else {
+		levelAttr.Value = slog.StringValue(levelName(r.Level))
+	}
+	if levelAttr.Key != "" {
+		cW(buf, h.useColor, levelColor(r.Level), "%s", levelAttr.Value.String())
+		buf.WriteString(" ")
 	}
-	cW(buf, true, levelColor(r.Level), "%s", levelAttr.Value.String())
-	buf.WriteString(" ")
 
-	if h.opts.AddSource {
-		file, line := r.SourceLine()
-		cW(buf, true, nGreen, "%s:%d", file, line)
+	if h.opts.AddSource && r.PC != 0 {
+		fs := runtime.CallersFrames([]uintptr{r.PC})
+		f, _ := fs.Next()
+		cW(buf, h.useColor, nGreen, "%s:%d", f.File, f.Line)
 		buf.WriteString(" ")
 	}
 
 	// write message to buf
-	cW(buf, true, nWhite, "%s", r.Message)
+	cW(buf, h.useColor, nWhite, "%s", r.Message)
 	buf.WriteString(" ")
 	// write preformatted attrs to buf
 	buf.Write(h.preformattedAttrs.Bytes())
-	// close group in preformatted attrs if open\
-	if h.groupOpen {
-		cW(h.preformattedAttrs, true, nWhite, "%s", "}")
+	// write the record's own attrs to buf, multi-line strings such as stack
+	// traces are written as blocks below the line
+	attrs := make([]slog.Attr, 0, r.NumAttrs())
+	var blocks []slog.Attr
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Value.Kind() == slog.KindString && strings.Contains(a.Value.String(), "\n") {
+			blocks = append(blocks, a)
+		} else {
+			attrs = append(attrs, a)
+		}
+		return true
+	})
+	h.writeAttrs(buf, h.groups, attrs, false)
+	// close groups opened in preformatted attrs
+	for range h.groups {
+		cW(buf, h.useColor, nWhite, "%s", "}")
 	}
 	buf.WriteString("\n")
+	for _, block := range h.resolveAttrs(h.groups, blocks) {
+		cW(buf, h.useColor, nYellow, "%s:\n", block.Key)
+		for _, line := range strings.Split(strings.TrimRight(block.Value.String(), "\n"), "\n") {
+			buf.WriteString("\t")
+			buf.WriteString(line)
+			buf.WriteString("\n")
+		}
+	}
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	h.w.Write(buf.Bytes())
@@ -101,74 +132,103 @@ func (h *PrettyHandler) Handle(r slog.Record) error {
 
 func (h *PrettyHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
 	h2 := h.clone()
-	writeAttrs(h2.preformattedAttrs, attrs, false)
+	h2.writeAttrs(h2.preformattedAttrs, h2.groups, attrs, false)
 	return h2
 }
 
-func writeAttrs(w *bytes.Buffer, attrs []slog.Attr, insideGroup bool) {
+// writeAttrs writes attrs nested in groups to w, applying ReplaceAttr and
+// dropping empty attrs the way the slog handlers do.
+func (h *PrettyHandler) writeAttrs(w *bytes.Buffer, groups []string, attrs []slog.Attr, insideGroup bool) {
+	attrs = h.resolveAttrs(groups, attrs)
 	for i, attr := range attrs {
-		cW(w, true, nYellow, "%s: ", attr.Key)
-		if insideGroup && i == len(attrs)-1 {
-			writeAttrValue(w, attr.Value, false)
-		} else {
-			writeAttrValue(w, attr.Value, true)
+		cW(w, h.useColor, nYellow, "%s: ", attr.Key)
+		appendSpace := !insideGroup || i < len(attrs)-1
+		if attr.Value.Kind() == slog.KindGroup {
+			cW(w, h.useColor, nWhite, "{")
+			h.writeAttrs(w, append(groups[:len(groups):len(groups)], attr.Key), attr.Value.Group(), true)
+			cW(w, h.useColor, nWhite, "%s", "}")
+			if appendSpace {
+				w.WriteString(" ")
+			}
+			continue
 		}
+		writeAttrValue(w, attr.Value, appendSpace, h.useColor)
 	}
 }
 
-func writeAttrValue(w *bytes.Buffer, value slog.Value, appendSpace bool) {
+func (h *PrettyHandler) resolveAttrs(groups []string, attrs []slog.Attr) []slog.Attr {
+	resolved := make([]slog.Attr, 0, len(attrs))
+	for _, attr := range attrs {
+		attr.Value = attr.Value.Resolve()
+		if attr.Value.Kind() == slog.KindGroup {
+			group := attr.Value.Group()
+			if len(group) == 0 {
+				continue
+			}
+			if attr.Key == "" {
+				// inline groups without a key
+				resolved = append(resolved, h.resolveAttrs(groups, group)...)
+				continue
+			}
+		} else if h.opts.ReplaceAttr != nil {
+			attr = h.opts.ReplaceAttr(groups, attr)
+			attr.Value = attr.Value.Resolve()
+		}
+		if attr.Equal(slog.Attr{}) {
+			continue
+		}
+		resolved = append(resolved, attr)
+	}
+	return resolved
+}
+
+func writeAttrValue(w *bytes.Buffer, value slog.Value, appendSpace, useColor bool) {
 	if appendSpace {
 		defer w.WriteString(" ")
 	}
 	switch v := value.Kind(); v {
-	case slog.StringKind:
-		cW(w, true, nCyan, "%q", value.String())
-	case slog.BoolKind:
-		cW(w, true, nCyan, "%t", value.Bool())
-	case slog.Int64Kind:
-		cW(w, true, nCyan, "%d", value.Int64())
-	case slog.DurationKind:
-		cW(w, true, nCyan, "%s", value.Duration().String())
-	case slog.Float64Kind:
-		cW(w, true, nCyan, "%f", value.Float64())
-	case slog.TimeKind:
-		cW(w, true, nCyan, "%s", value.Time().Format(time.RFC3339))
-	case slog.Uint64Kind:
-		cW(w, true, nCyan, "%d", value.Uint64())
-	case slog.GroupKind:
-		cW(w, true, nWhite, "{")
-		writeAttrs(w, value.Group(), true)
-		cW(w, true, nWhite, "%s", "}")
+	case slog.KindString:
+		cW(w, useColor, nCyan, "%q", value.String())
+	case slog.KindBool:
+		cW(w, useColor, nCyan, "%t", value.Bool())
+	case slog.KindInt64:
+		cW(w, useColor, nCyan, "%d", value.Int64())
+	case slog.KindDuration:
+		cW(w, useColor, nCyan, "%s", value.Duration().String())
+	case slog.KindFloat64:
+		cW(w, useColor, nCyan, "%f", value.Float64())
+	case slog.KindTime:
+		cW(w, useColor, nCyan, "%s", value.Time().Format(time.RFC3339))
+	case slog.KindUint64:
+		cW(w, useColor, nCyan, "%d", value.Uint64())
 	default:
-		cW(w, true, nCyan, "%s", value.String())
+		cW(w, useColor, nCyan, "%s", value.String())
 	}
 }
 
 func levelColor(l slog.Level) []byte {
-	switch l {
-	case slog.LevelDebug:
-		return nYellow
-	case slog.LevelInfo:
-		return nGreen
-	case slog.LevelWarn:
-		return nRed
-	case slog.LevelError:
+	switch {
+	case l >= slog.LevelError:
 		return bRed
+	case l >= slog.LevelWarn:
+		return nRed
+	case l >= slog.LevelInfo:
+		return nGreen
+	case l >= slog.LevelDebug:
+		return nYellow
 	default:
-		return bWhite
+		return nBlue
 	}
 }
 
 func (h *PrettyHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
 	h2 := h.clone()
-	if h2.groupPrefix != nil {
-		// end old group
-		cW(h2.preformattedAttrs, true, nWhite, "}")
-	}
-	h2.groupOpen = true
-	h2.groupPrefix = &name
-	cW(h2.preformattedAttrs, true, bMagenta, "%s: {", name)
-	return h
+	h2.groups = append(h2.groups[:len(h2.groups):len(h2.groups)], name)
+	cW(h2.preformattedAttrs, h2.useColor, bMagenta, "%s: {", name)
+	return h2
 }
 
 func (h *PrettyHandler) clone() *PrettyHandler {
@@ -176,9 +236,11 @@ func (h *PrettyHandler) clone() *PrettyHandler {
 	newBuffer.Write(h.preformattedAttrs.Bytes())
 
 	return &PrettyHandler{
+		mu:                h.mu,
 		opts:              h.opts,
 		w:                 h.w,
-		groupPrefix:       h.groupPrefix,
+		groups:            h.groups,
 		preformattedAttrs: newBuffer,
+		useColor:          h.useColor,
 	}
 }
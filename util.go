@@ -3,6 +3,10 @@ package httplog
 import (
 	"bytes"
 	"io"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
 )
 
 // limitBuffer is used to pipe response body information from the
@@ -11,27 +15,143 @@ import (
 // may log it.
 type limitBuffer struct {
 	*bytes.Buffer
-	limit int
+	limit     int
+	truncated bool
+	size      int
 }
 
-func newLimitBuffer(size int) io.ReadWriter {
-	return limitBuffer{
+func newLimitBuffer(size int) *limitBuffer {
+	return &limitBuffer{
 		Buffer: bytes.NewBuffer(make([]byte, 0, size)),
 		limit:  size,
 	}
 }
 
-func (b limitBuffer) Write(p []byte) (n int, err error) {
+func (b *limitBuffer) Write(p []byte) (n int, err error) {
+	b.size += len(p)
 	if b.Buffer.Len() >= b.limit {
+		b.truncated = b.truncated || len(p) > 0
 		return len(p), nil
 	}
-	limit := b.limit
+	limit := b.limit - b.Buffer.Len()
 	if len(p) < limit {
 		limit = len(p)
+	} else if len(p) > limit {
+		b.truncated = true
 	}
-	return b.Buffer.Write(p[:limit])
+	b.Buffer.Write(p[:limit])
+	return len(p), nil
 }
 
-func (b limitBuffer) Read(p []byte) (n int, err error) {
+func (b *limitBuffer) Read(p []byte) (n int, err error) {
 	return b.Buffer.Read(p)
 }
+
+// teeReadCloser copies everything read from the request body to w.
+type teeReadCloser struct {
+	io.ReadCloser
+	w io.Writer
+}
+
+func (t *teeReadCloser) Read(p []byte) (n int, err error) {
+	n, err = t.ReadCloser.Read(p)
+	if n > 0 {
+		t.w.Write(p[:n])
+	}
+	return n, err
+}
+
+// countReadCloser counts the bytes read from the request body.
+type countReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countReadCloser) Read(p []byte) (n int, err error) {
+	n, err = c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// matchPath reports whether the request path p matches pattern. Patterns are
+// either exact paths, path.Match patterns where "*" matches within a single
+// path segment, eg. "/v1/*/events", end in "/*" to match everything under a
+// prefix, eg. "/debug/*" matches "/debug/pprof/heap", or are regular
+// expressions prefixed with "~", eg. "~^/assets/.+\.js$".
+func matchPath(pattern, p string) bool {
+	if pattern == p {
+		return true
+	}
+	if expr, ok := strings.CutPrefix(pattern, "~"); ok {
+		re := cachedRegexp(expr)
+		return re != nil && re.MatchString(p)
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok && !strings.ContainsAny(prefix, "*?[\\") {
+		return strings.HasPrefix(p, prefix+"/")
+	}
+	ok, _ := path.Match(pattern, p)
+	return ok
+}
+
+// validPathPattern reports whether pattern is well-formed for matchPath.
+func validPathPattern(pattern string) error {
+	if expr, ok := strings.CutPrefix(pattern, "~"); ok {
+		_, err := regexp.Compile(expr)
+		return err
+	}
+	_, err := path.Match(pattern, "")
+	return err
+}
+
+// patternSpecificity ranks how specific a matchPath pattern is, an exact path
+// beats any wildcard or regular expression pattern, and longer patterns beat
+// shorter ones.
+func patternSpecificity(pattern string) int {
+	if !strings.HasPrefix(pattern, "~") && !strings.ContainsAny(pattern, "*?[") {
+		return 1<<31 - 1
+	}
+	return len(pattern)
+}
+
+// patternRegexps caches the compiled "~" patterns of matchPath and
+// matchHeader.
+var patternRegexps sync.Map // map[string]*regexp.Regexp
+
+// cachedRegexp compiles expr once, returning nil if it's malformed.
+func cachedRegexp(expr string) *regexp.Regexp {
+	if re, ok := patternRegexps.Load(expr); ok {
+		return re.(*regexp.Regexp)
+	}
+	compiled, err := regexp.Compile(expr)
+	if err != nil {
+		return nil
+	}
+	re, _ := patternRegexps.LoadOrStore(expr, compiled)
+	return re.(*regexp.Regexp)
+}
+
+// matchHeader reports whether the lower-cased header name matches pattern.
+// Patterns are either header names, path.Match patterns such as
+// "x-internal-*" or "*-token", or case-insensitive regular expressions
+// prefixed with "~", eg. "~^x-(api|auth)-key$".
+func matchHeader(pattern, name string) bool {
+	if pattern == name {
+		return true
+	}
+	if expr, ok := strings.CutPrefix(pattern, "~"); ok {
+		re := cachedRegexp("(?i)" + expr)
+		return re != nil && re.MatchString(name)
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// validHeaderPattern reports whether pattern is well-formed for matchHeader.
+func validHeaderPattern(pattern string) error {
+	if expr, ok := strings.CutPrefix(pattern, "~"); ok {
+		_, err := regexp.Compile(expr)
+		return err
+	}
+	_, err := path.Match(pattern, "")
+	return err
+}
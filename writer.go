@@ -0,0 +1,297 @@
+package httplog
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// responseWriter wraps the http.ResponseWriter of a request to record the
+// response for its log. It's created by newResponseWriter, which preserves
+// the optional interfaces of the underlying writer such as http.Flusher, so
+// eg. streaming handlers keep working behind the middleware.
+type responseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	explicit    bool // the status was set with WriteHeader
+	status      int
+	wroteAt     time.Time // when the first status, maybe interim, was sent
+	interim     []int     // informational statuses sent before status
+	bytes       int
+	tee         io.Writer
+	teeStatus   int // the minimum status of responses teed
+	hijacked    bool
+	pushed      int
+	writeErr    error // the first error writing to the client
+}
+
+// newResponseWriter wraps w, returning the writer to pass on to the handler,
+// which implements the same optional interfaces as w, and the recorded
+// response.
+func newResponseWriter(w http.ResponseWriter, protoMajor int) (http.ResponseWriter, *responseWriter) {
+	rw := &responseWriter{ResponseWriter: w}
+	_, fl := w.(http.Flusher)
+	if protoMajor == 2 {
+		_, ps := w.(http.Pusher)
+		if fl && ps {
+			return &http2FancyWriter{rw}, rw
+		}
+		if ps {
+			return &pushWriter{rw}, rw
+		}
+	} else {
+		_, hj := w.(http.Hijacker)
+		_, rf := w.(io.ReaderFrom)
+		switch {
+		case fl && hj && rf:
+			return &httpFancyWriter{rw}, rw
+		case fl && hj:
+			return &flushHijackWriter{rw}, rw
+		case fl && rf:
+			return &flushReadFromWriter{rw}, rw
+		case hj && rf:
+			return &hijackReadFromWriter{rw}, rw
+		case hj:
+			return &hijackWriter{rw}, rw
+		case rf:
+			return &readFromWriter{rw}, rw
+		}
+	}
+	if fl {
+		return &flushWriter{rw}, rw
+	}
+	return rw, rw
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if status >= 100 && status < 200 && status != http.StatusSwitchingProtocols && !w.wroteHeader {
+		// interim responses, eg. 103 Early Hints, precede the actual status
+		w.interim = append(w.interim, status)
+		w.markWrote()
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if !w.wroteHeader {
+		w.explicit = true
+		w.writeHeader(status)
+	}
+}
+
+func (w *responseWriter) writeHeader(status int) {
+	w.status = status
+	w.markWrote()
+	w.wroteHeader = true
+	if status < w.teeStatus {
+		w.tee = nil
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(buf []byte) (int, error) {
+	w.maybeWriteHeader()
+	n, err := w.ResponseWriter.Write(buf)
+	w.writeError(err)
+	if w.tee != nil {
+		_, teeErr := w.tee.Write(buf[:n])
+		// prefer errors of the underlying writer
+		if err == nil {
+			err = teeErr
+		}
+	}
+	w.bytes += n
+	return n, err
+}
+
+// Unwrap returns the underlying writer, for http.ResponseController to reach
+// eg. SetWriteDeadline or EnableFullDuplex through the middleware.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// maybeWriteHeader sends the implicit 200 status, if no status was sent yet.
+func (w *responseWriter) maybeWriteHeader() {
+	if !w.wroteHeader {
+		w.writeHeader(http.StatusOK)
+	}
+}
+
+func (w *responseWriter) writeError(err error) {
+	if err != nil && w.writeErr == nil {
+		w.writeErr = err
+	}
+}
+
+// WriteError returns the first error of writing or flushing the response,
+// eg. a broken pipe when the client went away.
+func (w *responseWriter) WriteError() error {
+	return w.writeErr
+}
+
+// Status returns the status sent, 0 if none was sent yet.
+func (w *responseWriter) Status() int {
+	return w.status
+}
+
+// Interim returns the informational statuses sent before the final one, eg.
+// 100 Continue or 103 Early Hints.
+func (w *responseWriter) Interim() []int {
+	return w.interim
+}
+
+// markWrote records when the first bytes of the response were sent.
+func (w *responseWriter) markWrote() {
+	if w.wroteAt.IsZero() {
+		w.wroteAt = time.Now()
+	}
+}
+
+// WroteAt returns when the first status was sent, including informational
+// ones such as 103 Early Hints, the zero time if none was sent yet.
+func (w *responseWriter) WroteAt() time.Time {
+	return w.wroteAt
+}
+
+// ExplicitStatus reports whether the handler called WriteHeader, rather than
+// the status being the implicit 200 of writing the body first.
+func (w *responseWriter) ExplicitStatus() bool {
+	return w.explicit
+}
+
+// BytesWritten returns the number of bytes of the response body sent.
+func (w *responseWriter) BytesWritten() int {
+	return w.bytes
+}
+
+// Hijacked reports whether the handler took over the connection.
+func (w *responseWriter) Hijacked() bool {
+	return w.hijacked
+}
+
+// Pushed returns the number of resources pushed with HTTP/2 server push.
+func (w *responseWriter) Pushed() int {
+	return w.pushed
+}
+
+// Tee makes the response body be written to tee as well, if the status is at
+// least minStatus.
+func (w *responseWriter) Tee(tee io.Writer, minStatus int) {
+	w.tee = tee
+	w.teeStatus = minStatus
+}
+
+// flush sends the implicit 200 status if needed, as the underlying writer
+// does, and flushes it.
+func (w *responseWriter) flush() {
+	w.maybeWriteHeader()
+	if f, ok := w.ResponseWriter.(interface{ FlushError() error }); ok {
+		// the writers of package http report errors this way
+		w.writeError(f.FlushError())
+		return
+	}
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+func (w *responseWriter) hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+func (w *responseWriter) push(target string, opts *http.PushOptions) error {
+	err := w.ResponseWriter.(http.Pusher).Push(target, opts)
+	if err == nil {
+		w.pushed++
+	}
+	return err
+}
+
+// readFrom lets the underlying writer use its io.ReaderFrom, eg. sendfile
+// for http.ServeFile, unless the body is teed.
+func (w *responseWriter) readFrom(r io.Reader) (int64, error) {
+	// the status decides whether the body is teed
+	w.maybeWriteHeader()
+	if w.tee != nil {
+		// copy through Write, which counts the bytes
+		return io.Copy(w, r)
+	}
+	n, err := w.ResponseWriter.(io.ReaderFrom).ReadFrom(r)
+	w.bytes += int(n)
+	w.writeError(err)
+	return n, err
+}
+
+type flushWriter struct{ *responseWriter }
+
+func (w *flushWriter) Flush() { w.flush() }
+
+type hijackWriter struct{ *responseWriter }
+
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) { return w.hijack() }
+
+type pushWriter struct{ *responseWriter }
+
+func (w *pushWriter) Push(target string, opts *http.PushOptions) error { return w.push(target, opts) }
+
+type readFromWriter struct{ *responseWriter }
+
+func (w *readFromWriter) ReadFrom(r io.Reader) (int64, error) { return w.readFrom(r) }
+
+type flushHijackWriter struct{ *responseWriter }
+
+func (w *flushHijackWriter) Flush() { w.flush() }
+
+func (w *flushHijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) { return w.hijack() }
+
+type flushReadFromWriter struct{ *responseWriter }
+
+func (w *flushReadFromWriter) Flush() { w.flush() }
+
+func (w *flushReadFromWriter) ReadFrom(r io.Reader) (int64, error) { return w.readFrom(r) }
+
+type hijackReadFromWriter struct{ *responseWriter }
+
+func (w *hijackReadFromWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) { return w.hijack() }
+
+func (w *hijackReadFromWriter) ReadFrom(r io.Reader) (int64, error) { return w.readFrom(r) }
+
+// httpFancyWriter is the common case of wrapping the writer of an HTTP/1.x
+// request of package http.
+type httpFancyWriter struct{ *responseWriter }
+
+func (w *httpFancyWriter) Flush() { w.flush() }
+
+func (w *httpFancyWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) { return w.hijack() }
+
+func (w *httpFancyWriter) ReadFrom(r io.Reader) (int64, error) { return w.readFrom(r) }
+
+// http2FancyWriter is the common case of wrapping the writer of an HTTP/2
+// request of package http.
+type http2FancyWriter struct{ *responseWriter }
+
+func (w *http2FancyWriter) Flush() { w.flush() }
+
+func (w *http2FancyWriter) Push(target string, opts *http.PushOptions) error {
+	return w.push(target, opts)
+}
+
+var (
+	_ http.Flusher  = &flushWriter{}
+	_ http.Hijacker = &hijackWriter{}
+	_ http.Pusher   = &pushWriter{}
+	_ io.ReaderFrom = &readFromWriter{}
+	_ http.Flusher  = &flushHijackWriter{}
+	_ http.Hijacker = &flushHijackWriter{}
+	_ http.Flusher  = &flushReadFromWriter{}
+	_ io.ReaderFrom = &flushReadFromWriter{}
+	_ http.Hijacker = &hijackReadFromWriter{}
+	_ io.ReaderFrom = &hijackReadFromWriter{}
+	_ http.Flusher  = &httpFancyWriter{}
+	_ http.Hijacker = &httpFancyWriter{}
+	_ io.ReaderFrom = &httpFancyWriter{}
+	_ http.Flusher  = &http2FancyWriter{}
+	_ http.Pusher   = &http2FancyWriter{}
+)